@@ -14,6 +14,10 @@ type Node struct {
 	Line   uint
 	Column uint
 
+	// Identifier as written in the source, the parser does not
+	// resolve names. Id is set from it in 'resolver'.
+	Name string
+
 	// Union could really help here... Sigh.
 
 	Int struct {
@@ -39,13 +43,31 @@ type Node struct {
 		Stmts []*Node
 	}
 
+	LVarDecl struct {
+		Type types.Id // IdNone if the type is inferred ('auto')
+	}
+
+	Typedef struct {
+		DefinedAs types.Id
+	}
+
 	Fun struct {
+		// Function declaration and definition
+		ParamDecls []*Node  // NodeLVarDecl for each parameter
+		Type       types.Id // Return type as written, may differ from declaration
+
+		// Attributes
+		Inline   bool
+		NoInline bool
+		Export   bool // Visible to other objects, like 'main'
+
 		// Function definiton
-		Params []symbol.Id
+		Params []symbol.Id // Set in 'resolver'
 		Stmts  []*Node
 
-		// Function call
+		// Function call and 'syscall'
 		Args []*Node
+		Tail bool // Written with 'tailcall', must be in tail position
 	}
 
 	// TODO: This is a dirty hack.
@@ -99,6 +121,7 @@ const (
 	NodeCast
 	NodeTypedef
 	NodeEmpty
+	NodeSyscall // Fun.Args holds the number and the arguments
 )
 
 type BinOpTag uint
@@ -190,6 +213,9 @@ func (n *Node) GetTypeShallow(t *symbol.Table) types.Id {
 	case NodeCast:
 		return n.Cast.To
 
+	case NodeSyscall:
+		return types.GetBuiltin(types.S64)
+
 	case NodeEmpty:
 		return types.GetBuiltin(types.Void)
 
@@ -200,15 +226,69 @@ func (n *Node) GetTypeShallow(t *symbol.Table) types.Id {
 
 // If the type is a defenition, recurses to get the actual type
 func (n *Node) GetTypeDeep(t *symbol.Table) types.Id {
-	typeId := n.GetTypeShallow(t)
-	{
-		typeNode := types.Get(typeId)
-		for typeNode.Tag == types.Definition {
-			typeId = typeNode.DefinedAs
-			typeNode = types.Get(typeId)
-		}
+	return n.GetTypeShallow(t).Underlying()
+}
+
+// Returns the statements and expressions directly below the node,
+// in evaluation order.
+func (n *Node) Children() []*Node {
+	children := []*Node{}
+
+	switch n.Tag {
+	case NodeBinOp:
+		children = append(children, n.BinOp.Lval, n.BinOp.Rval)
+
+	case NodeScope:
+		children = append(children, n.Scope.Stmts...)
+
+	case NodeFunDef:
+		children = append(children, n.Fun.Stmts...)
+
+	case NodeFunCall, NodeSyscall:
+		children = append(children, n.Fun.Args...)
+
+	case NodeReturn:
+		children = append(children, n.Return.Val)
+
+	case NodeIf:
+		children = append(children, n.If.Exp)
+		children = append(children, n.If.IfStmts...)
+		children = append(children, n.If.ElseStmts...)
+
+	case NodeWhile:
+		children = append(children, n.While.Exp)
+		children = append(children, n.While.Stmts...)
+
+	case NodeFor:
+		children = append(children, n.For.Init, n.For.Cond, n.For.Adv)
+		children = append(children, n.For.Stmts...)
+
+	case NodeCast:
+		children = append(children, n.Cast.What)
+	}
+
+	return children
+}
+
+// Calls visit on the node and everything below it, parents first
+func Walk(n *Node, visit func(*Node)) {
+	visit(n)
+	for _, child := range n.Children() {
+		Walk(child, visit)
+	}
+}
+
+// Reports whether a node with the tag is in any of the trees
+func Contains(roots []*Node, want tag) bool {
+	found := false
+	for _, root := range roots {
+		Walk(root, func(n *Node) {
+			if n.Tag == want {
+				found = true
+			}
+		})
 	}
-	return typeId
+	return found
 }
 
 func (n *Node) ReportHere(r *report.Reporter, tag report.ReportTag, msg string) {
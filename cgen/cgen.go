@@ -0,0 +1,497 @@
+// This file contains the C99 backend. It works on the checked AST,
+// so the output keeps the structure of the source.
+
+package cgen
+
+import (
+	"clic/ast"
+	"clic/symbol"
+	"clic/types"
+	"fmt"
+	"math"
+	"strings"
+)
+
+type generator struct {
+	t *symbol.Table
+
+	// Names of the types defined with 'typedef'
+	typedefs map[types.Id]string
+
+	// C names of the locals of the current function. A local is
+	// in scope in its own initializer in C, so shadowed names get
+	// the symbol id as a suffix.
+	locals map[symbol.Id]string
+	taken  map[string]bool
+
+	// Statements that have to run before the expression being
+	// generated, see genOperands()
+	pre   []string
+	temps int
+
+	indent int
+	code   string
+}
+
+func Codegen(roots []*ast.Node, t *symbol.Table) string {
+	g := generator{
+		t:        t,
+		typedefs: make(map[types.Id]string),
+	}
+
+	// 'syscall' comes from libc, which only declares it for
+	// _GNU_SOURCE
+	if ast.Contains(roots, ast.NodeSyscall) {
+		g.code += "#define _GNU_SOURCE\n"
+		g.code += "#include <unistd.h>\n"
+	}
+
+	g.code += "#include <stdint.h>\n"
+	g.code += "#include <stdbool.h>\n"
+
+	// Typedefs are written like in headers, after the ones they
+	// are defined with. The ones inside of functions are not
+	// needed, their variables use the underlying type.
+	for _, node := range roots {
+		if node.Tag == ast.NodeTypedef {
+			g.typedefs[t.Get(node.Id).Type] = Name(node.Name)
+		}
+	}
+	typedefs := ""
+	written := map[types.Id]bool{}
+	for _, node := range roots {
+		if node.Tag == ast.NodeTypedef {
+			typedefs += g.usedTypedefs(t.Get(node.Id).Type, written)
+		}
+	}
+	if typedefs != "" {
+		g.code += "\n" + typedefs
+	}
+
+	// Functions can be used before they are defined, so all of
+	// them get a prototype, including the ones declared inside of
+	// functions.
+	protos := ""
+	seen := map[string]bool{}
+	for _, root := range roots {
+		ast.Walk(root, func(n *ast.Node) {
+			switch n.Tag {
+			case ast.NodeFunEx, ast.NodeFunDecl, ast.NodeFunDef:
+				name := t.Get(n.Id).Name
+				if !seen[name] {
+					seen[name] = true
+					protos += g.prototype(n) + ";\n"
+				}
+			}
+		})
+	}
+	if protos != "" {
+		g.code += "\n" + protos
+	}
+
+	for _, node := range roots {
+		if node.Tag == ast.NodeFunDef {
+			g.code += "\n"
+			g.genFunction(node)
+		}
+	}
+
+	return g.code
+}
+
+// C types of the builtin types
+var builtinTypes = map[types.Id]string{
+	types.GetBuiltin(types.Void): "void",
+	types.GetBuiltin(types.S64):  "int64_t",
+	types.GetBuiltin(types.U64):  "uint64_t",
+	types.GetBuiltin(types.Bool): "bool",
+}
+
+// Returns the C type of a builtin type
+func Type(id types.Id) string {
+	name, ok := builtinTypes[id]
+	if !ok {
+		panic("not implemented")
+	}
+	return name
+}
+
+// Structs are written out in place, their fields keep the names of
+// the typedefs
+func (g *generator) typeName(id types.Id) string {
+	if name, ok := g.typedefs[id]; ok {
+		return name
+	}
+
+	node := types.Get(id.Underlying())
+	if node.Tag == types.Struct {
+		fields := ""
+		for _, field := range node.Fields {
+			fields += fmt.Sprintf(" %s %s;", g.typeName(field.Type), Name(field.Name))
+		}
+		return "struct {" + fields + " }"
+	}
+
+	return Type(id.Underlying())
+}
+
+// Names that mean something in C and in the included headers
+var reserved = map[string]bool{}
+
+func init() {
+	names := "auto break case char const continue default do double else " +
+		"enum extern float for goto if inline int long register restrict " +
+		"return short signed sizeof static struct switch typedef union " +
+		"unsigned void volatile while _Bool _Complex _Imaginary " +
+		"bool true false int8_t int16_t int32_t int64_t uint8_t uint16_t " +
+		"uint32_t uint64_t INT64_C UINT64_C INT64_MIN INT64_MAX UINT64_MAX"
+	for _, name := range strings.Fields(names) {
+		reserved[name] = true
+	}
+}
+
+const namePrefix = "_cli_"
+
+// Returns the C name of an identifier. Reserved names get a prefix,
+// and so do names that already have it, so they can't clash with
+// each other or with the temporaries.
+func Name(name string) string {
+	if reserved[name] || strings.HasPrefix(name, namePrefix) {
+		return namePrefix + name
+	}
+	return name
+}
+
+func (g *generator) prototype(n *ast.Node) string {
+	sym := g.t.Get(n.Id)
+
+	ret := g.typeName(sym.Type)
+	if sym.Name == "main" && sym.Type != types.GetBuiltin(types.Void) {
+		ret = "int"
+	}
+
+	params := []string{}
+	for _, param := range sym.Fun.Params {
+		params = append(params, g.typeName(param.Type)+" "+Name(param.Name))
+	}
+	if len(params) == 0 {
+		params = append(params, "void")
+	}
+
+	return fmt.Sprintf("%s %s(%s)", ret, Name(sym.Name), strings.Join(params, ", "))
+}
+
+func (g *generator) line(s string) {
+	g.code += strings.Repeat("    ", g.indent) + s + "\n"
+}
+
+// Writes the statements the expressions of a statement need, then
+// the statement itself
+func (g *generator) stmt(s string) {
+	for _, p := range g.pre {
+		g.line(p)
+	}
+	g.pre = nil
+	g.line(s)
+}
+
+func (g *generator) local(id symbol.Id) string {
+	if name, ok := g.locals[id]; ok {
+		return name
+	}
+
+	name := g.t.Get(id).Name
+	cname := Name(name)
+	if g.taken[cname] {
+		cname = fmt.Sprintf("%s%s_%d", namePrefix, name, id)
+	}
+	g.taken[cname] = true
+	g.locals[id] = cname
+	return cname
+}
+
+func (g *generator) genFunction(n *ast.Node) {
+	g.temps = 0
+	g.locals = make(map[symbol.Id]string)
+	g.taken = make(map[string]bool)
+
+	// The prototype has the names of the parameters
+	for _, param := range n.Fun.Params {
+		g.local(param)
+	}
+
+	g.line(g.prototype(n))
+	g.line("{")
+	g.indent++
+	g.genStmts(n.Fun.Stmts)
+	g.indent--
+	g.line("}")
+}
+
+func (g *generator) genStmts(stmts []*ast.Node) {
+	for _, stmt := range stmts {
+		g.genStmt(stmt)
+	}
+}
+
+func (g *generator) genBlock(stmts []*ast.Node) {
+	g.indent++
+	g.genStmts(stmts)
+	g.indent--
+}
+
+func (g *generator) genStmt(n *ast.Node) {
+	switch n.Tag {
+	case ast.NodeEmpty:
+
+	// Written at the top of the file, see 'Codegen'
+	case ast.NodeTypedef, ast.NodeFunEx, ast.NodeFunDecl:
+
+	case ast.NodeLVarDecl:
+		sym := g.t.Get(n.Id)
+		g.stmt(fmt.Sprintf("%s %s;", g.typeName(sym.Type), g.local(n.Id)))
+
+	case ast.NodeBinOp:
+		lval := n.BinOp.Lval
+		if n.BinOp.Tag == ast.BinOpAssign && lval.Tag == ast.NodeLVarDecl {
+			sym := g.t.Get(lval.Id)
+			rval := g.genExpr(n.BinOp.Rval)
+			g.stmt(fmt.Sprintf("%s %s = %s;", g.typeName(sym.Type), g.local(lval.Id), rval))
+			break
+		}
+		g.genExprStmt(n)
+
+	case ast.NodeScope:
+		g.line("{")
+		g.genBlock(n.Scope.Stmts)
+		g.line("}")
+
+	// C does not guarantee tail calls, a C compiler may still
+	// turn them into jumps.
+	case ast.NodeReturn:
+		val := n.Return.Val
+		if val.Tag == ast.NodeEmpty {
+			g.stmt("return;")
+		} else if val.GetTypeShallow(g.t) == types.GetBuiltin(types.Void) {
+			// C does not allow returning a void value
+			g.genExprStmt(val)
+			g.stmt("return;")
+		} else {
+			g.stmt(fmt.Sprintf("return %s;", g.genExpr(val)))
+		}
+
+	case ast.NodeIf:
+		g.stmt(fmt.Sprintf("if (%s) {", g.genExpr(n.If.Exp)))
+		g.genBlock(n.If.IfStmts)
+		if len(n.If.ElseStmts) != 0 {
+			g.line("} else {")
+			g.genBlock(n.If.ElseStmts)
+		}
+		g.line("}")
+
+	case ast.NodeWhile:
+		g.genLoop(n.While.Exp, n.While.Stmts, nil)
+
+	case ast.NodeFor:
+		g.line("{")
+		g.indent++
+		g.genStmt(n.For.Init)
+		g.genLoop(n.For.Cond, n.For.Stmts, n.For.Adv)
+		g.indent--
+		g.line("}")
+
+	default:
+		g.genExprStmt(n)
+	}
+}
+
+// A condition that needs statements before it is checked at the
+// top of an infinite loop, so they run on every iteration.
+func (g *generator) genLoop(cond *ast.Node, stmts []*ast.Node, adv *ast.Node) {
+	c := g.genExpr(cond)
+	pre := g.pre
+	g.pre = nil
+
+	if len(pre) == 0 {
+		g.line(fmt.Sprintf("while (%s) {", c))
+		g.indent++
+	} else {
+		g.line("for (;;) {")
+		g.indent++
+		g.pre = pre
+		g.stmt(fmt.Sprintf("if (!%s) {", paren(c)))
+		g.line("    break;")
+		g.line("}")
+	}
+
+	g.genStmts(stmts)
+	if adv != nil {
+		g.genStmt(adv)
+	}
+
+	g.indent--
+	g.line("}")
+}
+
+func (g *generator) genExprStmt(n *ast.Node) {
+	expr := g.genExpr(n)
+	isAssign := (n.Tag == ast.NodeBinOp) && (n.BinOp.Tag == ast.BinOpAssign)
+	if n.Tag == ast.NodeFunCall || isAssign {
+		g.stmt(expr + ";")
+	} else {
+		g.stmt(fmt.Sprintf("(void)%s;", paren(expr)))
+	}
+}
+
+// Wraps everything but names, literals and calls in parentheses
+func paren(expr string) string {
+	simple := true
+	depth := 0
+	for _, c := range expr {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ' ':
+			if depth == 0 {
+				simple = false
+			}
+		}
+	}
+	if expr[0] == '(' || expr[0] == '-' {
+		simple = false
+	}
+
+	if simple {
+		return expr
+	}
+	return "(" + expr + ")"
+}
+
+func hasEffects(n *ast.Node) bool {
+	effects := false
+	ast.Walk(n, func(n *ast.Node) {
+		isAssign := (n.Tag == ast.NodeBinOp) && (n.BinOp.Tag == ast.BinOpAssign)
+		if n.Tag == ast.NodeFunCall || n.Tag == ast.NodeSyscall || isAssign {
+			effects = true
+		}
+	})
+	return effects
+}
+
+// Operands are evaluated left to right, C leaves the order
+// unspecified. Everything before the last operand with effects is
+// computed into a temporary first.
+func (g *generator) genOperands(operands []*ast.Node) []string {
+	last := -1
+	for i, operand := range operands {
+		if hasEffects(operand) {
+			last = i
+		}
+	}
+
+	out := []string{}
+	for i, operand := range operands {
+		expr := g.genExpr(operand)
+
+		isLiteral := (operand.Tag == ast.NodeInt) || (operand.Tag == ast.NodeBool)
+		if i < last && !isLiteral {
+			temp := fmt.Sprintf("%st%d", namePrefix, g.temps)
+			g.temps++
+			typ := g.typeName(operand.GetTypeShallow(g.t))
+			g.pre = append(g.pre, fmt.Sprintf("%s %s = %s;", typ, temp, expr))
+			expr = temp
+		}
+
+		out = append(out, expr)
+	}
+	return out
+}
+
+var arithOps = map[ast.BinOpArithTag]string{
+	ast.BinOpSum:  "+",
+	ast.BinOpSub:  "-",
+	ast.BinOpMult: "*",
+	ast.BinOpDiv:  "/",
+	ast.BinOpMod:  "%",
+}
+
+var compOps = map[ast.BinOpCompTag]string{
+	ast.BinOpEq:      "==",
+	ast.BinOpNeq:     "!=",
+	ast.BinOpLessEq:  "<=",
+	ast.BinOpLess:    "<",
+	ast.BinOpGreatEq: ">=",
+	ast.BinOpGreat:   ">",
+}
+
+func (g *generator) genExpr(n *ast.Node) string {
+	switch n.Tag {
+	case ast.NodeInt:
+		if !n.Int.Signed {
+			return fmt.Sprintf("UINT64_C(%d)", n.Int.UValue)
+		}
+		if n.Int.SValue == math.MinInt64 {
+			return "INT64_MIN"
+		}
+		return fmt.Sprintf("INT64_C(%d)", n.Int.SValue)
+
+	case ast.NodeBool:
+		if n.Bool.Value {
+			return "true"
+		}
+		return "false"
+
+	case ast.NodeLVar:
+		return g.local(n.Id)
+
+	case ast.NodeFunCall:
+		args := g.genOperands(n.Fun.Args)
+		return fmt.Sprintf("%s(%s)", Name(g.t.Get(n.Id).Name), strings.Join(args, ", "))
+
+	case ast.NodeSyscall:
+		args := g.genOperands(n.Fun.Args)
+		return fmt.Sprintf("(int64_t)syscall(%s)", strings.Join(args, ", "))
+
+	case ast.NodeCast:
+		what := g.genExpr(n.Cast.What)
+		return fmt.Sprintf("(%s)%s", g.typeName(n.Cast.To), paren(what))
+
+	case ast.NodeBinOp:
+		return g.genBinOp(n)
+
+	default:
+		panic("not implemented")
+	}
+}
+
+func (g *generator) genBinOp(n *ast.Node) string {
+	if n.BinOp.Tag == ast.BinOpAssign {
+		name := g.local(n.BinOp.Lval.Id)
+		return fmt.Sprintf("%s = %s", name, g.genExpr(n.BinOp.Rval))
+	}
+
+	operands := g.genOperands([]*ast.Node{n.BinOp.Lval, n.BinOp.Rval})
+	lval, rval := paren(operands[0]), paren(operands[1])
+
+	switch n.BinOp.Tag {
+	case ast.BinOpArith:
+		op := arithOps[n.BinOp.ArithTag]
+		signed := n.BinOp.Lval.GetTypeDeep(g.t) == types.GetBuiltin(types.S64)
+
+		// Signed overflow is undefined in C, but wraps around
+		// in CLI.
+		wraps := op == "+" || op == "-" || op == "*"
+		if signed && wraps {
+			return fmt.Sprintf("(int64_t)((uint64_t)%s %s (uint64_t)%s)", lval, op, rval)
+		}
+		return fmt.Sprintf("%s %s %s", lval, op, rval)
+
+	case ast.BinOpComp:
+		return fmt.Sprintf("%s %s %s", lval, compOps[n.BinOp.CompTag], rval)
+
+	default:
+		panic("not implemented")
+	}
+}
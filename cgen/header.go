@@ -0,0 +1,111 @@
+// This file contains the generator of C headers, so C code can call
+// the exported functions of a CLI program.
+
+package cgen
+
+import (
+	"clic/ast"
+	"clic/symbol"
+	"clic/types"
+	"fmt"
+	"strings"
+)
+
+// Returns a header with the prototypes of the exported functions and
+// the typedefs they use. 'name' is the file name of the header, the
+// include guard is made from it.
+func Header(roots []*ast.Node, t *symbol.Table, name string) string {
+	g := generator{
+		t:        t,
+		typedefs: make(map[types.Id]string),
+	}
+
+	for _, node := range roots {
+		if node.Tag == ast.NodeTypedef {
+			g.typedefs[t.Get(node.Id).Type] = Name(node.Name)
+		}
+	}
+
+	typedefs := ""
+	written := map[types.Id]bool{}
+	protos := ""
+	for _, node := range roots {
+		if node.Tag != ast.NodeFunDef || !node.Fun.Export {
+			continue
+		}
+
+		sym := t.Get(node.Id)
+		typedefs += g.usedTypedefs(sym.Type, written)
+		for _, param := range sym.Fun.Params {
+			typedefs += g.usedTypedefs(param.Type, written)
+		}
+		// Names that are reserved in C keep their symbol
+		proto := g.prototype(node)
+		if Name(sym.Name) != sym.Name {
+			proto += fmt.Sprintf(" __asm__(\"%s\")", sym.Name)
+		}
+		protos += proto + ";\n"
+	}
+
+	guard := headerGuard(name)
+
+	code := fmt.Sprintf("#ifndef %s\n", guard)
+	code += fmt.Sprintf("#define %s\n", guard)
+	code += "\n"
+	code += "#include <stdint.h>\n"
+	code += "#include <stdbool.h>\n"
+	if typedefs != "" {
+		code += "\n" + typedefs
+	}
+	if protos != "" {
+		code += "\n" + protos
+	}
+	code += "\n"
+	code += fmt.Sprintf("#endif // %s\n", guard)
+
+	return code
+}
+
+// Returns the typedefs a type needs that are not written yet. A
+// typedef comes after the ones it is defined with, since the fields
+// of structs keep their names.
+func (g *generator) usedTypedefs(id types.Id, written map[types.Id]bool) string {
+	if written[id] {
+		return ""
+	}
+	written[id] = true
+
+	node := types.Get(id)
+	switch node.Tag {
+	case types.Definition:
+		code := g.usedTypedefs(node.DefinedAs, written)
+		if name, ok := g.typedefs[id]; ok {
+			code += fmt.Sprintf("typedef %s %s;\n", g.typeName(node.DefinedAs), name)
+		}
+		return code
+
+	case types.Struct:
+		code := ""
+		for _, field := range node.Fields {
+			code += g.usedTypedefs(field.Type, written)
+		}
+		return code
+
+	default:
+		return ""
+	}
+}
+
+// FOO_H for "foo.h"
+func headerGuard(name string) string {
+	guard := []byte(strings.ToUpper(name))
+	for i, c := range guard {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			guard[i] = '_'
+		}
+	}
+	if len(guard) == 0 || (guard[0] >= '0' && guard[0] <= '9') {
+		guard = append([]byte{'_'}, guard...)
+	}
+	return string(guard)
+}
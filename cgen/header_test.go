@@ -0,0 +1,76 @@
+package cgen
+
+import (
+	"clic/ast"
+	"clic/checker"
+	"clic/parser"
+	"clic/report"
+	"clic/resolver"
+	"clic/symbol"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func check(t *testing.T, src string) ([]*ast.Node, *symbol.Table) {
+	tab := &symbol.Table{}
+	r := &report.Reporter{FileName: t.Name()}
+
+	asts := parser.New(src, r).CreateASTs()
+	resolver.Resolve(asts, tab, r)
+	checker.TypeCheck(asts, tab, r)
+	if r.HasErrors() {
+		t.Fatal("the program has errors")
+	}
+	return asts, tab
+}
+
+// Structs come after the typedefs of their fields, and the header
+// has to compile on its own
+func TestHeaderStructs(t *testing.T) {
+	asts, tab := check(t, `
+(typedef coord: s64)
+(typedef point: struct (x:coord y:coord))
+(typedef segment: struct (a:point b:point))
+(typedef seg: segment)
+(defun length (s:seg) coord (export)
+    (return (coord 0)))
+(defun origin (p:point) bool (export)
+    (return true))
+`)
+
+	header := Header(asts, tab, "geo.h")
+
+	want := []string{
+		"typedef int64_t coord;\n" +
+			"typedef struct { coord x; coord y; } point;\n" +
+			"typedef struct { point a; point b; } segment;\n" +
+			"typedef segment seg;\n",
+		"coord length(seg s);\n" +
+			"bool origin(point p);\n",
+	}
+	for _, w := range want {
+		if !strings.Contains(header, w) {
+			t.Errorf("header is missing\n%s\ngot\n%s", w, header)
+		}
+	}
+
+	cc := os.Getenv("CC")
+	if cc == "" {
+		cc = "cc"
+	}
+	if _, err := exec.LookPath(cc); err != nil {
+		t.Skipf("no C compiler: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "geo.h")
+	if err := os.WriteFile(path, []byte(header), 0666); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(cc, "-fsyntax-only", path).CombinedOutput()
+	if err != nil {
+		t.Errorf("%s: %s\n%s", cc, err, out)
+	}
+}
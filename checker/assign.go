@@ -0,0 +1,123 @@
+// This file contains the definite assignment analysis for local
+// variables declared with 'let'.
+
+package checker
+
+import (
+	"clic/ast"
+	"clic/report"
+	"clic/symbol"
+	"fmt"
+)
+
+type assignState struct {
+	// Only variables declared without an initial value are
+	// tracked here. True means assigned on every path.
+	vars map[symbol.Id]bool
+
+	// Set after 'return', merging ignores such states.
+	unreachable bool
+}
+
+func (s assignState) copy() assignState {
+	vars := make(map[symbol.Id]bool, len(s.vars))
+	for id, assigned := range s.vars {
+		vars[id] = assigned
+	}
+	return assignState{vars: vars, unreachable: s.unreachable}
+}
+
+func (s assignState) merge(other assignState) assignState {
+	if s.unreachable {
+		return other
+	}
+	if other.unreachable {
+		return s
+	}
+
+	merged := s.copy()
+	for id, assigned := range s.vars {
+		merged.vars[id] = assigned && other.vars[id]
+	}
+	return merged
+}
+
+func checkFunAssign(n *ast.Node, t *symbol.Table, r *report.Reporter) {
+	s := assignState{vars: make(map[symbol.Id]bool)}
+	assignStmts(n.Fun.Stmts, s, t, r)
+}
+
+func assignStmts(stmts []*ast.Node, s assignState, t *symbol.Table, r *report.Reporter) assignState {
+	for _, stmt := range stmts {
+		s = assignNode(stmt, s, t, r)
+	}
+	return s
+}
+
+func assignNode(n *ast.Node, s assignState, t *symbol.Table, r *report.Reporter) assignState {
+	switch n.Tag {
+	case ast.NodeLVarDecl:
+		// Declarations from 'auto' are handled in the assignment.
+		if n.Id != symbol.IdNone {
+			s.vars[n.Id] = false
+		}
+
+	case ast.NodeLVar:
+		assigned, tracked := s.vars[n.Id]
+		if tracked && !assigned && !s.unreachable {
+			n.ReportHere(r, report.ReportNonfatal,
+				fmt.Sprintf("local variable '%s' is used before being assigned",
+					t.Get(n.Id).Name))
+			// Report only the first use
+			s.vars[n.Id] = true
+		}
+
+	case ast.NodeBinOp:
+		if n.BinOp.Tag == ast.BinOpAssign {
+			s = assignNode(n.BinOp.Rval, s, t, r)
+			if n.BinOp.Lval.Tag == ast.NodeLVar {
+				if _, tracked := s.vars[n.BinOp.Lval.Id]; tracked {
+					s.vars[n.BinOp.Lval.Id] = true
+				}
+			}
+		} else {
+			s = assignNode(n.BinOp.Lval, s, t, r)
+			s = assignNode(n.BinOp.Rval, s, t, r)
+		}
+
+	case ast.NodeFunCall, ast.NodeSyscall:
+		for _, arg := range n.Fun.Args {
+			s = assignNode(arg, s, t, r)
+		}
+
+	case ast.NodeCast:
+		s = assignNode(n.Cast.What, s, t, r)
+
+	case ast.NodeScope:
+		s = assignStmts(n.Scope.Stmts, s, t, r)
+
+	case ast.NodeReturn:
+		s = assignNode(n.Return.Val, s, t, r)
+		s.unreachable = true
+
+	case ast.NodeIf:
+		s = assignNode(n.If.Exp, s, t, r)
+		ifState := assignStmts(n.If.IfStmts, s.copy(), t, r)
+		elseState := assignStmts(n.If.ElseStmts, s.copy(), t, r)
+		s = ifState.merge(elseState)
+
+	case ast.NodeWhile:
+		// The body may not run at all, so assignments in it do
+		// not count after the loop.
+		s = assignNode(n.While.Exp, s, t, r)
+		assignStmts(n.While.Stmts, s.copy(), t, r)
+
+	case ast.NodeFor:
+		s = assignNode(n.For.Init, s, t, r)
+		s = assignNode(n.For.Cond, s, t, r)
+		body := assignStmts(n.For.Stmts, s.copy(), t, r)
+		assignNode(n.For.Adv, body, t, r)
+	}
+
+	return s
+}
@@ -0,0 +1,72 @@
+// This file contains the control flow analysis functions.
+
+package checker
+
+import (
+	"clic/ast"
+	"clic/report"
+	"clic/symbol"
+	"clic/types"
+	"fmt"
+)
+
+func checkFunFlow(n *ast.Node, t *symbol.Table, r *report.Reporter) {
+	returns := checkStmtsFlow(n.Fun.Stmts, r)
+
+	funType := t.Get(n.Id).Type
+	voidType := types.GetBuiltin(types.Void)
+
+	if funType != voidType && !returns {
+		n.ReportHere(r, report.ReportNonfatal,
+			fmt.Sprintf("function '%s' does not return on every path",
+				t.Get(n.Id).Name))
+	}
+}
+
+// Returns true if control never reaches the end of the statement
+// list. Statements after such a point are reported as unreachable.
+func checkStmtsFlow(stmts []*ast.Node, r *report.Reporter) bool {
+	returns := false
+
+	for _, stmt := range stmts {
+		if returns {
+			stmt.ReportHere(r, report.ReportWarning, "unreachable code")
+			break
+		}
+		returns = checkNodeFlow(stmt, r)
+	}
+
+	return returns
+}
+
+func checkNodeFlow(n *ast.Node, r *report.Reporter) bool {
+	switch n.Tag {
+	case ast.NodeReturn:
+		return true
+
+	case ast.NodeScope:
+		return checkStmtsFlow(n.Scope.Stmts, r)
+
+	case ast.NodeIf:
+		ifReturns := checkStmtsFlow(n.If.IfStmts, r)
+		elseReturns := checkStmtsFlow(n.If.ElseStmts, r)
+		return ifReturns && elseReturns
+
+	case ast.NodeWhile:
+		checkStmtsFlow(n.While.Stmts, r)
+		// There is no 'break', so a loop on a constant true
+		// condition can only be left with 'return'.
+		return isTrueLiteral(n.While.Exp)
+
+	case ast.NodeFor:
+		checkStmtsFlow(n.For.Stmts, r)
+		return isTrueLiteral(n.For.Cond)
+
+	default:
+		return false
+	}
+}
+
+func isTrueLiteral(n *ast.Node) bool {
+	return n.Tag == ast.NodeBool && n.Bool.Value
+}
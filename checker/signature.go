@@ -0,0 +1,93 @@
+// This file contains the function signature checks.
+
+package checker
+
+import (
+	"clic/ast"
+	"clic/report"
+	"clic/symbol"
+	"clic/types"
+	"fmt"
+)
+
+// The parser keeps the parameters of the declaration in the symbol
+// table, so the definition has to be compared against it here.
+func checkSignature(n *ast.Node, t *symbol.Table, r *report.Reporter) {
+	sym := t.Get(n.Id)
+	params := defParams(n, t)
+
+	match := len(params) == len(sym.Fun.Params) && n.Fun.Type == sym.Type
+	if match {
+		for i, param := range params {
+			if param.Type != sym.Fun.Params[i].Type {
+				match = false
+				break
+			}
+		}
+	}
+
+	if !match {
+		msg := fmt.Sprintf("definition of '%s' does not match its declaration\n\tdeclared: %s\n\tdefined: %s",
+			sym.Name,
+			stringifySignature(sym.Fun.Params, sym.Type),
+			stringifySignature(params, n.Fun.Type))
+		n.ReportHere(r, report.ReportNonfatal, msg)
+	}
+}
+
+func checkVoidParams(n *ast.Node, params []symbol.TypedIdent, r *report.Reporter) {
+	voidType := types.GetBuiltin(types.Void)
+
+	for _, param := range params {
+		if param.Type.Underlying() == voidType {
+			n.ReportHere(r, report.ReportNonfatal,
+				fmt.Sprintf("parameter '%s' is of type %s",
+					param.Name, voidType.Stringify()))
+		}
+	}
+}
+
+// C code only sees an unnamed struct in the prototype, where it
+// is a new type no caller can pass, so exported functions need a
+// typedef for it.
+func checkExportTypes(n *ast.Node, params []symbol.TypedIdent, r *report.Reporter) {
+	if !n.Fun.Export {
+		return
+	}
+
+	if types.Get(n.Fun.Type).Tag == types.Struct {
+		n.ReportHere(r, report.ReportNonfatal,
+			"exported function returns an unnamed struct, give it a typedef")
+	}
+	for _, param := range params {
+		if types.Get(param.Type).Tag == types.Struct {
+			n.ReportHere(r, report.ReportNonfatal,
+				fmt.Sprintf("parameter '%s' of an exported function is an unnamed struct, give it a typedef",
+					param.Name))
+		}
+	}
+}
+
+func defParams(n *ast.Node, t *symbol.Table) []symbol.TypedIdent {
+	params := []symbol.TypedIdent{}
+	for _, id := range n.Fun.Params {
+		sym := t.Get(id)
+		params = append(params, symbol.TypedIdent{
+			Name: sym.Name,
+			Type: sym.Type,
+		})
+	}
+	return params
+}
+
+func stringifySignature(params []symbol.TypedIdent, ret types.Id) string {
+	s := "("
+	for i, param := range params {
+		if i > 0 {
+			s += " "
+		}
+		s += param.Type.Stringify()
+	}
+	s += ") " + ret.Stringify()
+	return s
+}
@@ -14,6 +14,81 @@ func TypeCheck(roots []*ast.Node, t *symbol.Table, r *report.Reporter) {
 	for _, node := range roots {
 		checkNode(node, t, r)
 	}
+
+	checkUsage(roots, t, r)
+}
+
+const maxSyscallArgs = 6
+
+// Arguments of tail calls have to fit in registers, the frame of
+// the caller is gone
+const maxTailCallArgs = 6
+
+// Literal zero, through any conversions
+func isZero(n *ast.Node) bool {
+	for n.Tag == ast.NodeCast {
+		n = n.Cast.What
+	}
+
+	switch n.Tag {
+	case ast.NodeInt:
+		return n.Int.SValue == 0 && n.Int.UValue == 0
+	case ast.NodeBool:
+		return !n.Bool.Value
+	default:
+		return false
+	}
+}
+
+// 'ret' is the return the call is the value of, 'tailcall' is only
+// allowed there
+func checkCall(n *ast.Node, ret *ast.Node, t *symbol.Table, r *report.Reporter) {
+	if n.Fun.Tail && ret == nil {
+		n.ReportHere(r, report.ReportNonfatal,
+			"tail call is not directly under return")
+	}
+	if n.Fun.Tail && len(n.Fun.Args) > maxTailCallArgs {
+		n.ReportHere(r, report.ReportNonfatal,
+			fmt.Sprintf("tail call with more than %d arguments", maxTailCallArgs))
+	}
+
+	for _, node := range n.Fun.Args {
+		checkNode(node, t, r)
+	}
+
+	if n.Id != function {
+		markUsed(n.Id, t)
+	}
+
+	fun := t.Get(n.Id).Fun
+
+	if len(n.Fun.Args) != len(fun.Params) {
+		n.ReportHere(r, report.ReportNonfatal,
+			fmt.Sprintf("expected %d arguments, got %d", len(fun.Params), len(n.Fun.Args)))
+		return
+	}
+
+	mismatch := false
+	for i, arg := range n.Fun.Args {
+		if arg.GetTypeShallow(t) != fun.Params[i].Type {
+			mismatch = true
+			break
+		}
+	}
+	if mismatch {
+		got := ""
+		expected := ""
+		for _, arg := range n.Fun.Args {
+			got += arg.GetTypeShallow(t).Stringify() + " "
+		}
+		for _, param := range fun.Params {
+			expected += param.Type.Stringify() + " "
+		}
+
+		msg := fmt.Sprintf("mismatched types in function call\n\tgot %s\n\texpected %s",
+			got, expected)
+		n.ReportHere(r, report.ReportNonfatal, msg)
+	}
 }
 
 func checkNode(n *ast.Node, t *symbol.Table, r *report.Reporter) {
@@ -23,7 +98,11 @@ func checkNode(n *ast.Node, t *symbol.Table, r *report.Reporter) {
 
 	switch n.Tag {
 	case ast.NodeBinOp:
-		checkNode(n.BinOp.Lval, t, r)
+		// Assigning to a variable is not a read
+		isAssign := (n.BinOp.Tag == ast.BinOpAssign)
+		if !isAssign || n.BinOp.Lval.Tag != ast.NodeLVar {
+			checkNode(n.BinOp.Lval, t, r)
+		}
 		checkNode(n.BinOp.Rval, t, r)
 
 		lvalType := n.BinOp.Lval.GetTypeShallow(t)
@@ -49,47 +128,40 @@ func checkNode(n *ast.Node, t *symbol.Table, r *report.Reporter) {
 					lvalStr, rvalStr))
 		}
 
-		isAssign := (n.BinOp.Tag == ast.BinOpAssign)
 		isStorage := ((n.BinOp.Lval.Tag == ast.NodeLVar) || (n.BinOp.Lval.Tag == ast.NodeLVarDecl))
 		if isAssign && !isStorage {
 			n.ReportHere(r, report.ReportNonfatal,
 				"lvalue is not a storage location")
 		}
 
+		// Computed divisors are left for run time
+		isDiv := (n.BinOp.Tag == ast.BinOpArith) &&
+			(n.BinOp.ArithTag == ast.BinOpDiv || n.BinOp.ArithTag == ast.BinOpMod)
+		if isDiv && isZero(n.BinOp.Rval) {
+			n.ReportHere(r, report.ReportNonfatal, "division by zero")
+		}
+
 	case ast.NodeFunCall:
+		checkCall(n, nil, t, r)
+
+	// Arguments are passed in registers, as integers
+	case ast.NodeSyscall:
 		for _, node := range n.Fun.Args {
 			checkNode(node, t, r)
 		}
 
-		fun := t.Get(n.Id).Fun
-
-		if len(n.Fun.Args) != len(fun.Params) {
+		if len(n.Fun.Args) < 1 || len(n.Fun.Args) > maxSyscallArgs+1 {
 			n.ReportHere(r, report.ReportNonfatal,
-				fmt.Sprintf("expected %d arguments, got %d", len(fun.Params), len(n.Fun.Args)))
-			return
+				fmt.Sprintf("syscall takes a number and up to %d arguments", maxSyscallArgs))
 		}
 
-		mismatch := false
-		for i, arg := range n.Fun.Args {
-			if arg.GetTypeShallow(t) != fun.Params[i].Type {
-				mismatch = true
-				break
+		for _, arg := range n.Fun.Args {
+			argType := arg.GetTypeDeep(t)
+			if argType != types.GetBuiltin(types.S64) && argType != types.GetBuiltin(types.U64) {
+				arg.ReportHere(r, report.ReportNonfatal,
+					fmt.Sprintf("expected an integer, got %s", arg.GetTypeShallow(t).Stringify()))
 			}
 		}
-		if mismatch {
-			got := ""
-			expected := ""
-			for _, arg := range n.Fun.Args {
-				got += arg.GetTypeShallow(t).Stringify() + " "
-			}
-			for _, param := range fun.Params {
-				expected += param.Type.Stringify() + " "
-			}
-
-			msg := fmt.Sprintf("mismatched types in function call\n\tgot %s\n\texpected %s",
-				got, expected)
-			n.ReportHere(r, report.ReportNonfatal, msg)
-		}
 
 	case ast.NodeIf:
 		checkNode(n.If.Exp, t, r)
@@ -149,6 +221,8 @@ func checkNode(n *ast.Node, t *symbol.Table, r *report.Reporter) {
 		// convert between all of them. This code only checks
 		// for new and unsupported types.
 
+		checkNode(n.Cast.What, t, r)
+
 		from := n.Cast.What.GetTypeDeep(t)
 
 		switch from {
@@ -176,14 +250,31 @@ func checkNode(n *ast.Node, t *symbol.Table, r *report.Reporter) {
 		}
 
 	case ast.NodeFunDef:
-		// TODO: Add check for void return type and signature
+		checkSignature(n, t, r)
+		checkVoidParams(n, defParams(n, t), r)
+		checkExportTypes(n, defParams(n, t), r)
+
+		if n.Fun.Inline && n.Fun.NoInline {
+			n.ReportHere(r, report.ReportNonfatal,
+				"function can't be both inline and noinline")
+		}
+
+		function = n.Id
 		for _, stmt := range n.Fun.Stmts {
 			checkNode(stmt, t, r)
 		}
+		function = symbol.IdNone
+
+		checkFunFlow(n, t, r)
+		checkFunAssign(n, t, r)
 
 	// TODO: Add check for void
 	case ast.NodeReturn:
-		checkNode(n.Return.Val, t, r)
+		if n.Return.Val.Tag == ast.NodeFunCall {
+			checkCall(n.Return.Val, n, t, r)
+		} else {
+			checkNode(n.Return.Val, t, r)
+		}
 
 		funType := t.Get(n.Return.Fun).Type
 		valType := n.Return.Val.GetTypeShallow(t)
@@ -194,13 +285,25 @@ func checkNode(n *ast.Node, t *symbol.Table, r *report.Reporter) {
 					funType.Stringify(), valType.Stringify()))
 		}
 
+	case ast.NodeLVar:
+		markUsed(n.Id, t)
+
+	case ast.NodeFunEx:
+		checkVoidParams(n, t.Get(n.Id).Fun.Params, r)
+
+	case ast.NodeFunDecl:
+		checkVoidParams(n, t.Get(n.Id).Fun.Params, r)
+
+	case ast.NodeTypedef:
+		voidType := types.GetBuiltin(types.Void)
+		if t.Get(n.Id).Type.Underlying() == voidType {
+			n.ReportHere(r, report.ReportNonfatal,
+				fmt.Sprintf("can't define a type as %s", voidType.Stringify()))
+		}
+
 	// Do nothing
 	case ast.NodeInt:
-	case ast.NodeLVar:
 	case ast.NodeBool:
-	case ast.NodeFunEx: // TODO: Add check for 'void' params
-	case ast.NodeTypedef: // TODO: Add check for 'void'
-	case ast.NodeFunDecl: // TODO: Add check for 'void' params
 	case ast.NodeEmpty:
 
 	default:
@@ -0,0 +1,95 @@
+// This file contains the unused symbol analysis. Symbols are marked
+// as used in 'checkNode', so this should run after type checking.
+
+package checker
+
+import (
+	"clic/ast"
+	"clic/report"
+	"clic/symbol"
+	"fmt"
+	"strings"
+)
+
+// Function being checked, calls to itself are not counted as uses
+var function = symbol.IdNone
+
+func markUsed(id symbol.Id, t *symbol.Table) {
+	sym := t.Get(id)
+	sym.Used = true
+	t.Set(id, sym)
+}
+
+func checkUsage(roots []*ast.Node, t *symbol.Table, r *report.Reporter) {
+	for _, node := range roots {
+		if node.Tag != ast.NodeFunDef {
+			continue
+		}
+
+		// Exported functions are used by other objects
+		if t.Get(node.Id).Name != "main" && !node.Fun.Export {
+			reportUnused(node.Id, "function", t, r)
+		}
+
+		for _, param := range node.Fun.Params {
+			reportUnused(param, "parameter", t, r)
+		}
+		for _, stmt := range node.Fun.Stmts {
+			checkUsageNode(stmt, t, r)
+		}
+	}
+}
+
+func checkUsageNode(n *ast.Node, t *symbol.Table, r *report.Reporter) {
+	switch n.Tag {
+	case ast.NodeLVarDecl:
+		reportUnused(n.Id, "local variable", t, r)
+
+	case ast.NodeBinOp:
+		checkUsageNode(n.BinOp.Lval, t, r)
+		checkUsageNode(n.BinOp.Rval, t, r)
+
+	case ast.NodeScope:
+		for _, stmt := range n.Scope.Stmts {
+			checkUsageNode(stmt, t, r)
+		}
+
+	case ast.NodeIf:
+		for _, stmt := range n.If.IfStmts {
+			checkUsageNode(stmt, t, r)
+		}
+		for _, stmt := range n.If.ElseStmts {
+			checkUsageNode(stmt, t, r)
+		}
+
+	case ast.NodeWhile:
+		for _, stmt := range n.While.Stmts {
+			checkUsageNode(stmt, t, r)
+		}
+
+	case ast.NodeFor:
+		checkUsageNode(n.For.Init, t, r)
+		for _, stmt := range n.For.Stmts {
+			checkUsageNode(stmt, t, r)
+		}
+	}
+}
+
+// Names starting with '_' are never reported
+func reportUnused(id symbol.Id, what string, t *symbol.Table, r *report.Reporter) {
+	if id == symbol.IdNone {
+		return
+	}
+
+	sym := t.Get(id)
+	if sym.Used || strings.HasPrefix(sym.Name, "_") {
+		return
+	}
+
+	r.Report(report.Form{
+		Tag:    report.ReportWarning,
+		Line:   sym.Line,
+		Column: sym.Column,
+		Msg:    fmt.Sprintf("%s '%s' is never used", what, sym.Name),
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"clic/codegen"
+	"clic/ir"
+	"clic/opt"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Compiles a CLI file to assembly and has the C compiler assemble
+// and link it with the rest of the inputs. Only exits on bad usage.
+func build(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	outFlag := flags.String("o", "a.out", "Executable output path")
+	saveTempsFlag := flags.Bool("save-temps", false, "Keep the intermediate files in the current directory")
+	freestandingFlag := flags.Bool("freestanding", false, "Link a static executable without libc")
+	sharedFlag := flags.Bool("shared", false, "Link a shared library, lib<infile>.so unless -o is given")
+	headerFlag := flags.String("emit-header", "", "Also write a C header of the exported functions to this path")
+	newPipeline := pipelineFlags(flags)
+
+	// Libraries look like flags, and flags may come after the
+	// inputs
+	inputs := []string{}
+	libs := []string{}
+	rest := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-l") || strings.HasPrefix(arg, "-L") {
+			libs = append(libs, arg)
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	for {
+		flags.Parse(rest)
+		if flags.NArg() == 0 {
+			break
+		}
+		inputs = append(inputs, flags.Arg(0))
+		rest = flags.Args()[1:]
+	}
+
+	source := ""
+	others := []string{}
+	for _, input := range inputs {
+		if filepath.Ext(input) == ".cli" && source == "" {
+			source = input
+		} else {
+			others = append(others, input)
+		}
+	}
+	if source == "" {
+		fmt.Println("Usage: clic build [-o outfile] [--save-temps] [--freestanding|--shared] [--emit-header foo.h] [-O0|-O1|-O2] infile [file.c|file.o|-llib...]")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *freestandingFlag && *sharedFlag {
+		return errors.New("--freestanding and --shared can't be used together")
+	}
+
+	name := strings.TrimSuffix(filepath.Base(source), ".cli")
+
+	// Modes of the C compiler
+	ccFlags := []string{}
+	if *freestandingFlag {
+		ccFlags = append(ccFlags, "-nostdlib", "-static")
+	}
+	if *sharedFlag {
+		ccFlags = append(ccFlags, "-shared", "-fPIC")
+
+		outSet := false
+		flags.Visit(func(f *flag.Flag) {
+			outSet = outSet || f.Name == "o"
+		})
+		if !outSet {
+			*outFlag = "lib" + name + ".so"
+		}
+	}
+
+	pipeline := newPipeline()
+	asts, t, err := load(source, pipeline)
+	if err != nil {
+		return err
+	}
+
+	prog := ir.Lower(asts, t, pipeline.Has(opt.PassTailCall))
+	pipeline.RunIR(prog)
+	asm := codegen.Codegen(prog, codegen.Options{
+		Target:   codegen.TargetX86_64,
+		Regalloc: pipeline.Has(opt.PassRegalloc),
+		Peephole: pipeline.Has(opt.PassPeephole),
+
+		Freestanding: *freestandingFlag,
+		PIC:          *sharedFlag,
+	})
+
+	dir := "."
+	if !*saveTempsFlag {
+		dir, err = os.MkdirTemp("", "clic-")
+		if err != nil {
+			return err
+		}
+	}
+
+	asmPath := filepath.Join(dir, name+".s")
+	err = os.WriteFile(asmPath, []byte(asm), 0666)
+	if err == nil {
+		err = link(*outFlag, asmPath, others, libs, ccFlags)
+	}
+
+	if !*saveTempsFlag {
+		os.RemoveAll(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only a successful build gets a header
+	if *headerFlag != "" {
+		return writeHeader(*headerFlag, asts, t)
+	}
+	return nil
+}
+
+// $CC picks the C compiler, like in make
+func link(out string, asmPath string, others []string, libs []string, ccFlags []string) error {
+	cc := os.Getenv("CC")
+	if cc == "" {
+		cc = "cc"
+	}
+
+	args := append([]string{"-o", out}, ccFlags...)
+	args = append(args, asmPath)
+	args = append(args, others...)
+	args = append(args, libs...)
+
+	cmd := exec.Command(cc, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", cc, err)
+	}
+	return nil
+}
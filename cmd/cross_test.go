@@ -0,0 +1,97 @@
+package main
+
+import (
+	"clic/codegen"
+	"clic/ir"
+	"clic/opt"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Cross compilers and user mode emulators of the other targets
+var crossTargets = []struct {
+	name string
+	cc   string
+	qemu string
+}{
+	{"aarch64-linux", "aarch64-linux-gnu-gcc", "qemu-aarch64"},
+	{"riscv64-linux", "riscv64-linux-gnu-gcc", "qemu-riscv64"},
+}
+
+// Like 'TestExamples', but the assembly of the other targets runs
+// in qemu. Skips the targets without a toolchain.
+func TestCrossExamples(t *testing.T) {
+	paths, err := filepath.Glob("../examples/*.cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	prints := filepath.Join(dir, "prints.c")
+	if err := os.WriteFile(prints, []byte(printsC), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cross := range crossTargets {
+		t.Run(cross.name, func(t *testing.T) {
+			target, err := codegen.ParseTarget(cross.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tool := range []string{cross.cc, cross.qemu} {
+				if _, err := exec.LookPath(tool); err != nil {
+					t.Skipf("no %s: %s", tool, err)
+				}
+			}
+
+			for _, path := range paths {
+				for _, level := range []int{0, defaultLevel} {
+					example := filepath.Base(path)
+					t.Run(fmt.Sprintf("%s/O%d", example, level), func(t *testing.T) {
+						skipExample(t, example)
+
+						want, wantRes := runInterp(t, path)
+						exe := buildCross(t, path, level, target, cross.cc, prints, dir)
+						got, res := runExe(t, cross.qemu, exe)
+						if got != want || res != wantRes&0xff {
+							t.Errorf("%s printed\n%s(returned %d)\ninterpreter printed\n%s(returned %d)",
+								cross.name, got, res, want, wantRes&0xff)
+						}
+					})
+				}
+			}
+		})
+	}
+}
+
+// Static, so qemu needs no sysroot for the C library
+func buildCross(t *testing.T, path string, level int, target codegen.Target, cc string, prints string, dir string) string {
+	pipeline := opt.NewPipeline(level)
+	asts, tab, err := load(path, pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog := ir.Lower(asts, tab, pipeline.Has(opt.PassTailCall))
+	pipeline.RunIR(prog)
+	asm := codegen.Codegen(prog, codegen.Options{
+		Target:   target,
+		Regalloc: pipeline.Has(opt.PassRegalloc),
+		Peephole: pipeline.Has(opt.PassPeephole),
+	})
+
+	base := filepath.Join(dir, fmt.Sprintf("%s-O%d-%d", filepath.Base(path), level, target))
+	if err := os.WriteFile(base+".s", []byte(asm), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	exe := base + ".out"
+	out, err := exec.Command(cc, "-static", "-o", exe, base+".s", prints).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s\n%s", cc, err, out)
+	}
+	return exe
+}
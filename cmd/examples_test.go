@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"clic/interp"
+	"clic/opt"
+	"clic/vm"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// The print functions of the interpreter, for the native builds
+const printsC = `#include <stdio.h>
+#include <stdint.h>
+#include <stdbool.h>
+
+void print_s64(int64_t n) { printf("%lld\n", (long long)n); }
+void print_u64(uint64_t n) { printf("%llu\n", (unsigned long long)n); }
+void print_bool(bool b) { printf("%s\n", b ? "true" : "false"); }
+`
+
+// Every example has to print the same and return the same from
+// 'main' in the interpreter, the VM and a native build.
+func TestExamples(t *testing.T) {
+	paths, err := filepath.Glob("../examples/*.cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	prints := filepath.Join(dir, "prints.c")
+	if err := os.WriteFile(prints, []byte(printsC), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		name := filepath.Base(path)
+		t.Run(name, func(t *testing.T) {
+			skipExample(t, name)
+
+			want, wantRes := runInterp(t, path)
+
+			got, res := runVM(t, path)
+			if got != want || res != wantRes {
+				t.Errorf("VM printed\n%s(returned %d)\ninterpreter printed\n%s(returned %d)", got, res, want, wantRes)
+			}
+
+			got, res = runNative(t, path, prints, dir)
+			if got != want || res != wantRes&0xff {
+				t.Errorf("native build printed\n%s(returned %d)\ninterpreter printed\n%s(returned %d)", got, res, want, wantRes&0xff)
+			}
+		})
+	}
+}
+
+func skipExample(t *testing.T, name string) {
+	switch name {
+	// Only a native build can make system calls
+	case "freestanding.cli":
+		t.Skip("uses syscall")
+	// It runs for a minute outside of native code
+	case "bench.cli":
+		if os.Getenv("CLIC_BENCH") == "" {
+			t.Skip("set CLIC_BENCH=1 to run it")
+		}
+	}
+}
+
+func runInterp(t *testing.T, path string) (string, uint64) {
+	var out bytes.Buffer
+	asts, tab, err := load(path, opt.NewPipeline(0))
+	if err != nil {
+		t.Fatalf("interpreter: %s", err)
+	}
+	res, err := interp.New(asts, tab, &out).Call("main")
+	if err != nil {
+		t.Fatalf("interpreter: %s", err)
+	}
+	return out.String(), res
+}
+
+func runVM(t *testing.T, path string) (string, uint64) {
+	var out bytes.Buffer
+	pipeline := opt.NewPipeline(defaultLevel)
+	asts, tab, err := load(path, pipeline)
+	if err != nil {
+		t.Fatalf("VM: %s", err)
+	}
+	prog, err := vm.Compile(asts, tab, pipeline.Has(opt.PassTailCall))
+	if err != nil {
+		t.Fatalf("VM: %s", err)
+	}
+
+	m := vm.New(prog)
+	registerPrints(m, &out)
+	res, err := m.Call("main")
+	if err != nil {
+		t.Fatalf("VM: %s", err)
+	}
+	return out.String(), res
+}
+
+// Skips when there is no C compiler to link with
+func runNative(t *testing.T, path string, prints string, dir string) (string, uint64) {
+	cc := os.Getenv("CC")
+	if cc == "" {
+		cc = "cc"
+	}
+	if _, err := exec.LookPath(cc); err != nil {
+		t.Skipf("no C compiler: %s", err)
+	}
+
+	exe := filepath.Join(dir, filepath.Base(path)+".out")
+	if err := build([]string{"-o", exe, path, prints}); err != nil {
+		t.Fatalf("native build: %s", err)
+	}
+
+	return runExe(t, exe)
+}
+
+// The output and the exit code of a program
+func runExe(t *testing.T, name string, args ...string) (string, uint64) {
+	out, err := exec.Command(name, args...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), uint64(exitErr.ExitCode())
+	}
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return string(out), 0
+}
+
+// The interpreter and the VM overflow at the same depth
+func TestRecursionLimit(t *testing.T) {
+	const src = `
+(defun f (n:s64) s64
+    (if (== n 0) (return 0))
+    (auto r (+ (f (- n 1)) 1))
+    (return r))
+(defun main () s64
+    (auto r (f %d))
+    (return r))
+`
+
+	// 'main' and n+1 calls of 'f'
+	for _, n := range []int{vm.MaxFrames - 2, vm.MaxFrames - 1} {
+		path := filepath.Join(t.TempDir(), "deep.cli")
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(src, n)), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		asts, tab, err := load(path, opt.NewPipeline(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, interpErr := interp.New(asts, tab, io.Discard).Call("main")
+
+		pipeline := opt.NewPipeline(defaultLevel)
+		asts, tab, err = load(path, pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog, err := vm.Compile(asts, tab, pipeline.Has(opt.PassTailCall))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, vmErr := vm.New(prog).Call("main")
+
+		overflow := n == vm.MaxFrames-1
+		if (interpErr != nil) != overflow || (vmErr != nil) != overflow {
+			t.Errorf("depth %d: interpreter: %v, VM: %v", n+2, interpErr, vmErr)
+		}
+	}
+}
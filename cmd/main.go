@@ -1,53 +1,319 @@
 package main
 
 import (
+	"bufio"
+	"clic/ast"
+	"clic/cgen"
 	"clic/checker"
 	"clic/codegen"
+	"clic/interp"
+	"clic/ir"
+	"clic/llvm"
+	"clic/opt"
 	"clic/parser"
 	"clic/report"
+	"clic/resolver"
 	"clic/symbol"
+	"clic/vm"
+	"clic/wasm"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 )
 
+const defaultLevel = 1
+
 func main() {
-	outFlag := flag.String("o", "out.s", "Assembly output path")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "run":
+			run(os.Args[2:])
+			return
+		case "build":
+			if err := build(os.Args[2:]); err != nil {
+				fail(err)
+			}
+			return
+		}
+	}
+
+	outFlag := flag.String("o", "out.s", "Assembly output path, out.o with -c")
+	objFlag := flag.Bool("c", false, "Write an x86_64 ELF object file instead of assembly")
 	dumpFlag := flag.Bool("dump", false, "Dump assembly output to stdout instead of writing it to file")
+	emitFlag := flag.String("emit", "asm", "Output kind: asm, ir, c, llvm or wat")
+	targetFlag := flag.String("target", "x86_64-linux", "Target of the assembly: x86_64-linux, aarch64-linux or riscv64-linux")
+	freestandingFlag := flag.Bool("freestanding", false, "Add a '_start' entry point, so the program runs without libc")
+	picFlag := flag.Bool("fPIC", false, "Generate position independent code for shared libraries")
+	headerFlag := flag.String("emit-header", "", "Also write a C header of the exported functions to this path")
+
+	newPipeline := pipelineFlags(flag.CommandLine)
+
 	flag.Parse()
 
 	if len(flag.Args()) != 1 {
-		fmt.Println("Usage: clic [-o outfile] infile")
+		fmt.Println("Usage: clic [-c] [-o outfile] [--emit=asm|ir|c|llvm|wat] [--target=x86_64-linux|aarch64-linux|riscv64-linux] [--freestanding] [-fPIC] [--emit-header foo.h] [-O0|-O1|-O2] infile")
+		fmt.Println("       clic run [--interp] infile")
+		fmt.Println("       clic build [-o outfile] [--save-temps] [--freestanding|--shared] [--emit-header foo.h] [-O0|-O1|-O2] infile [file.c|file.o|-llib...]")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	input := flag.Args()[0]
-	data, err := os.ReadFile(input)
+	target, err := codegen.ParseTarget(*targetFlag)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	t := &symbol.Table{}
-	r := &report.Reporter{FileName: input}
-	p := parser.New(string(data), t, r)
+	pipeline := newPipeline()
 
-	asts := p.CreateASTs()
-	r.ExitOnErrors(1)
+	if *freestandingFlag && *emitFlag != "asm" {
+		fmt.Println("--freestanding only supports assembly")
+		os.Exit(1)
+	}
 
-	checker.TypeCheck(asts, t, r)
-	r.ExitOnErrors(1)
+	if *objFlag {
+		if *emitFlag != "asm" || target != codegen.TargetX86_64 {
+			fmt.Println("-c only supports assembly for x86_64-linux")
+			os.Exit(1)
+		}
+
+		outSet := false
+		flag.Visit(func(f *flag.Flag) {
+			outSet = outSet || f.Name == "o"
+		})
+		if !outSet {
+			*outFlag = "out.o"
+		}
+	}
+
+	asts, t := frontend(flag.Args()[0], pipeline)
+
+	// The header is only written once the backend is done, so a
+	// program it can't compile leaves no header behind
+	finish := func(out []byte) {
+		if *headerFlag != "" {
+			if err := writeHeader(*headerFlag, asts, t); err != nil {
+				fail(err)
+			}
+		}
+		write(out, *outFlag, *dumpFlag)
+	}
+
+	// These work on the AST
+	switch *emitFlag {
+	case "c":
+		finish([]byte(cgen.Codegen(asts, t)))
+		return
+	case "wat":
+		finish([]byte(wasm.Codegen(asts, t, pipeline.Has(opt.PassTailCall))))
+		return
+	}
+
+	prog := ir.Lower(asts, t, pipeline.Has(opt.PassTailCall))
+	pipeline.RunIR(prog)
 
-	asm := codegen.Codegen(asts, t)
+	options := codegen.Options{
+		Target:   target,
+		Regalloc: pipeline.Has(opt.PassRegalloc),
+		Peephole: pipeline.Has(opt.PassPeephole),
 
-	if *dumpFlag {
-		fmt.Print(asm)
-	} else {
-		err = os.WriteFile(*outFlag, []byte(asm), 0666)
+		Freestanding: *freestandingFlag,
+		PIC:          *picFlag,
+	}
+	if *objFlag {
+		finish(codegen.Object(prog, options))
+		return
+	}
+
+	out := ""
+	switch *emitFlag {
+	case "asm":
+		out = codegen.Codegen(prog, options)
+	case "ir":
+		out = prog.Stringify()
+	case "llvm":
+		out = llvm.Codegen(prog)
+	default:
+		fmt.Printf("unknown output kind '%s'\n", *emitFlag)
+		os.Exit(1)
+	}
+
+	finish([]byte(out))
+}
+
+func writeHeader(path string, asts []*ast.Node, t *symbol.Table) error {
+	return os.WriteFile(path, []byte(cgen.Header(asts, t, filepath.Base(path))), 0666)
+}
+
+func write(out []byte, path string, dump bool) {
+	if dump {
+		os.Stdout.Write(out)
+		return
+	}
+
+	err := os.WriteFile(path, out, 0666)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// Adds the optimization flags, the returned function builds the
+// pipeline from them after parsing. Exits on unknown passes.
+func pipelineFlags(flags *flag.FlagSet) func() opt.Pipeline {
+	levelFlags := []*bool{}
+	for level := 0; level <= opt.MaxLevel; level++ {
+		usage := fmt.Sprintf("Optimization level %d", level)
+		if level == defaultLevel {
+			usage += " (default)"
+		}
+		levelFlags = append(levelFlags, flags.Bool(fmt.Sprintf("O%d", level), false, usage))
+	}
+	enableFlag := flags.String("enable", "", "Comma separated passes to run on top of the -O level: "+opt.PassNames())
+	disableFlag := flags.String("disable", "", "Comma separated passes to skip")
+
+	return func() opt.Pipeline {
+		// The highest level given wins
+		level := defaultLevel
+		for i, set := range levelFlags {
+			if *set {
+				level = i
+			}
+		}
+
+		pipeline := opt.NewPipeline(level)
+		err := pipeline.Toggle(*enableFlag, true)
+		if err == nil {
+			err = pipeline.Toggle(*disableFlag, false)
+		}
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		return pipeline
+	}
+}
+
+// The reporter already printed the errors of the program
+var errReported = errors.New("the program has errors")
+
+// Parses and checks the input, then runs the passes on the AST
+func load(input string, pipeline opt.Pipeline) (asts []*ast.Node, t *symbol.Table, err error) {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t = &symbol.Table{}
+	r := &report.Reporter{FileName: input}
+	defer func() {
+		if p := recover(); p != nil {
+			if _, ok := p.(report.Fatal); !ok {
+				panic(p)
+			}
+			asts, t, err = nil, nil, errReported
+		}
+	}()
+
+	asts = parser.New(string(data), r).CreateASTs()
+	if r.HasErrors() {
+		return nil, nil, errReported
+	}
+
+	resolver.Resolve(asts, t, r)
+	if r.HasErrors() {
+		return nil, nil, errReported
+	}
+
+	checker.TypeCheck(asts, t, r)
+	if r.HasErrors() {
+		return nil, nil, errReported
+	}
+
+	pipeline.Run(asts, t, r)
+	if r.HasErrors() {
+		return nil, nil, errReported
+	}
+
+	return asts, t, nil
+}
+
+// Like 'load', but exits on errors
+func frontend(input string, pipeline opt.Pipeline) ([]*ast.Node, *symbol.Table) {
+	asts, t, err := load(input, pipeline)
+	if err != nil {
+		fail(err)
+	}
+	return asts, t
+}
+
+func fail(err error) {
+	if err != errReported {
+		fmt.Println(err)
+	}
+	os.Exit(1)
+}
+
+// Runs the program on the bytecode VM or the interpreter, the
+// result of 'main' is the exit code
+func run(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	interpFlag := flags.Bool("interp", false, "Walk the unoptimized AST instead of running bytecode")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: clic run [--interp] infile")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+
+	// The interpreter is the reference, so it sees the program
+	// as written
+	if *interpFlag {
+		asts, t := frontend(flags.Arg(0), opt.NewPipeline(0))
+		res, err := interp.New(asts, t, out).Call("main")
+		exit(out, res, err)
+	}
+
+	pipeline := opt.NewPipeline(defaultLevel)
+	asts, t := frontend(flags.Arg(0), pipeline)
+	prog, err := vm.Compile(asts, t, pipeline.Has(opt.PassTailCall))
+	if err != nil {
+		exit(out, 0, err)
+	}
+	m := vm.New(prog)
+	registerPrints(m, out)
+
+	res, err := m.Call("main")
+	exit(out, res, err)
+}
+
+// The same print functions the interpreter has built in
+func registerPrints(m *vm.Machine, out io.Writer) {
+	m.Register("print_s64", func(args []uint64) uint64 {
+		fmt.Fprintln(out, int64(args[0]))
+		return 0
+	})
+	m.Register("print_u64", func(args []uint64) uint64 {
+		fmt.Fprintln(out, args[0])
+		return 0
+	})
+	m.Register("print_bool", func(args []uint64) uint64 {
+		fmt.Fprintln(out, args[0] != 0)
+		return 0
+	})
+}
+
+func exit(out *bufio.Writer, res uint64, err error) {
+	out.Flush()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	os.Exit(int(int32(res)))
 }
@@ -0,0 +1,280 @@
+// This file contains the AArch64 Linux (AAPCS64) codegen. It uses
+// the same frame layout as x86_64, with x29 as the frame pointer.
+
+package codegen
+
+import (
+	"clic/ir"
+	"fmt"
+)
+
+// Allocatable registers, all of them are caller saved. x15 and x17
+// hold operands that are in the frame, x16 holds addresses of
+// frame offsets that don't fit in an instruction.
+var a64AllocRegs = []string{"x9", "x10", "x11", "x12", "x13", "x14"}
+
+const a64ArgRegsCount = 8
+
+var a64CondCodes = map[ir.Op]string{
+	ir.OpEq:  "eq",
+	ir.OpNe:  "ne",
+	ir.OpSLt: "lt",
+	ir.OpSLe: "le",
+	ir.OpSGt: "gt",
+	ir.OpSGe: "ge",
+	ir.OpULt: "lo",
+	ir.OpULe: "ls",
+	ir.OpUGt: "hi",
+	ir.OpUGe: "hs",
+}
+
+var a64ArithInstrs = map[ir.Op]string{
+	ir.OpAdd:  "add",
+	ir.OpSub:  "sub",
+	ir.OpMul:  "mul",
+	ir.OpSDiv: "sdiv",
+	ir.OpUDiv: "udiv",
+}
+
+func genA64Function(f *ir.Func, o Options) []instr {
+	e := emitter{}
+
+	regs := make([]string, len(f.Temps))
+	if o.Regalloc {
+		regs = allocRegisters(f, a64AllocRegs)
+	}
+	fr := setVarOffsets(f, regs)
+
+	e.label(f.Name)
+	e.emit("stp", "x29", "x30", "[sp, #-16]!")
+	e.emit("mov", "x29", "sp")
+	if fr.size < 4096 {
+		e.emit("sub", "sp", "sp", fmt.Sprintf("#%d", fr.size))
+	} else {
+		e.a64LoadImm("x16", int64(fr.size))
+		e.emit("sub", "sp", "sp", "x16")
+	}
+
+	if len(f.Params) > a64ArgRegsCount {
+		panic("arguments on stack are not supported yet")
+	}
+	for i, slot := range f.Params {
+		e.a64Store(f.Slots[slot].Type, fmt.Sprintf("x%d", i), fr.slots[slot])
+	}
+
+	for id, block := range f.Blocks {
+		e.label(blockLabel(f, ir.BlockId(id)))
+		for _, instr := range block.Instrs {
+			e.a64GenInstr(f, &fr, &instr)
+		}
+	}
+
+	return e.instrs
+}
+
+// Views a 64 bit register as its low 32 bits
+func a64W(reg string) string {
+	return "w" + reg[1:]
+}
+
+// Accesses the frame at -offset from x29. 'op' is the unscaled
+// form, which only takes offsets down to -256.
+func (e *emitter) a64Frame(op string, reg string, offset uint) {
+	if offset <= 256 {
+		e.emit(op, reg, fmt.Sprintf("[x29, #-%d]", offset))
+		return
+	}
+
+	scaled := map[string]string{
+		"ldur":  "ldr",
+		"stur":  "str",
+		"ldurb": "ldrb",
+		"sturb": "strb",
+	}
+	e.a64LoadImm("x16", int64(offset))
+	e.emit("sub", "x16", "x29", "x16")
+	e.emit(scaled[op], reg, "[x16]")
+}
+
+func (e *emitter) a64Load(t ir.Type, reg string, offset uint) {
+	switch t {
+	case ir.I1:
+		e.a64Frame("ldurb", a64W(reg), offset)
+	case ir.I64:
+		e.a64Frame("ldur", reg, offset)
+	default:
+		panic("not implemented")
+	}
+}
+
+func (e *emitter) a64Store(t ir.Type, reg string, offset uint) {
+	switch t {
+	case ir.I1:
+		e.a64Frame("sturb", a64W(reg), offset)
+	case ir.I64:
+		e.a64Frame("stur", reg, offset)
+	default:
+		panic("not implemented")
+	}
+}
+
+func (e *emitter) a64LoadImm(reg string, imm int64) {
+	if imm >= -65536 && imm < 65536 {
+		e.emit("mov", reg, fmt.Sprintf("#%d", imm))
+		return
+	}
+
+	bits := uint64(imm)
+	e.emit("movz", reg, fmt.Sprintf("#%d", bits&0xffff))
+	for shift := 16; shift < 64; shift += 16 {
+		chunk := (bits >> shift) & 0xffff
+		if chunk != 0 {
+			e.emit("movk", reg, fmt.Sprintf("#%d", chunk), fmt.Sprintf("lsl #%d", shift))
+		}
+	}
+}
+
+// Returns the register holding the temporary, loading it to
+// 'scratch' if it is spilled
+func (e *emitter) a64Use(fr *frame, t ir.Temp, scratch string) string {
+	if fr.regs[t] != "" {
+		return fr.regs[t]
+	}
+	e.a64Frame("ldur", scratch, fr.spills[t])
+	return scratch
+}
+
+// Returns the register to compute the temporary in. 'a64Def' has to
+// be called after the computation.
+func (fr *frame) a64Dst(t ir.Temp) string {
+	if fr.regs[t] != "" {
+		return fr.regs[t]
+	}
+	return "x15"
+}
+
+func (e *emitter) a64Def(fr *frame, t ir.Temp) {
+	if fr.regs[t] == "" {
+		e.a64Frame("stur", "x15", fr.spills[t])
+	}
+}
+
+func (e *emitter) a64Epilogue() {
+	e.emit("mov", "sp", "x29")
+	e.emit("ldp", "x29", "x30", "[sp]", "#16")
+}
+
+// Allocatable registers and argument registers don't overlap, so
+// the moves can't clobber each other.
+func (e *emitter) a64MoveArgs(fr *frame, args []ir.Temp) {
+	if len(args) > a64ArgRegsCount {
+		panic("arguments on stack are not supported yet")
+	}
+
+	for j, arg := range args {
+		dst := fmt.Sprintf("x%d", j)
+		if fr.regs[arg] != "" {
+			e.emit("mov", dst, fr.regs[arg])
+		} else {
+			e.a64Frame("ldur", dst, fr.spills[arg])
+		}
+	}
+}
+
+func (e *emitter) a64GenInstr(f *ir.Func, fr *frame, i *ir.Instr) {
+	switch i.Op {
+	case ir.OpConst:
+		e.a64LoadImm(fr.a64Dst(i.Dst), i.Imm)
+		e.a64Def(fr, i.Dst)
+
+	case ir.OpLoad:
+		e.a64Load(i.Type, fr.a64Dst(i.Dst), fr.slots[i.Slot])
+		e.a64Def(fr, i.Dst)
+
+	case ir.OpStore:
+		src := e.a64Use(fr, i.Args[0], "x15")
+		e.a64Store(i.Type, src, fr.slots[i.Slot])
+
+	// Bools are kept zero extended, so this is a copy
+	case ir.OpCopy, ir.OpZext:
+		src := e.a64Use(fr, i.Args[0], "x15")
+		e.emit("mov", fr.a64Dst(i.Dst), src)
+		e.a64Def(fr, i.Dst)
+
+	case ir.OpAdd, ir.OpSub, ir.OpMul, ir.OpSDiv, ir.OpUDiv:
+		lval := e.a64Use(fr, i.Args[0], "x15")
+		rval := e.a64Use(fr, i.Args[1], "x17")
+		e.emit(a64ArithInstrs[i.Op], fr.a64Dst(i.Dst), lval, rval)
+		e.a64Def(fr, i.Dst)
+
+	// Division does not compute the remainder
+	case ir.OpSRem, ir.OpURem:
+		lval := e.a64Use(fr, i.Args[0], "x15")
+		rval := e.a64Use(fr, i.Args[1], "x17")
+		div := "sdiv"
+		if i.Op == ir.OpURem {
+			div = "udiv"
+		}
+		e.emit(div, "x16", lval, rval)
+		e.emit("msub", fr.a64Dst(i.Dst), "x16", rval, lval)
+		e.a64Def(fr, i.Dst)
+
+	case ir.OpEq, ir.OpNe, ir.OpSLt, ir.OpSLe, ir.OpSGt, ir.OpSGe,
+		ir.OpULt, ir.OpULe, ir.OpUGt, ir.OpUGe:
+		lval := e.a64Use(fr, i.Args[0], "x15")
+		rval := e.a64Use(fr, i.Args[1], "x17")
+		e.emit("cmp", lval, rval)
+		e.emit("cset", fr.a64Dst(i.Dst), a64CondCodes[i.Op])
+		e.a64Def(fr, i.Dst)
+
+	case ir.OpCall:
+		e.a64MoveArgs(fr, i.Args)
+		e.emit("bl", i.Fun)
+
+		if i.Dst != ir.TempNone {
+			// Only the low byte is defined for bools
+			if i.Type == ir.I1 {
+				e.emit("and", "x0", "x0", "#0xff")
+			}
+			e.emit("mov", fr.a64Dst(i.Dst), "x0")
+			e.a64Def(fr, i.Dst)
+		}
+
+	// The number goes in x8, the kernel preserves everything
+	// but x0
+	case ir.OpSyscall:
+		e.a64MoveArgs(fr, i.Args[1:])
+		num := e.a64Use(fr, i.Args[0], "x8")
+		if num != "x8" {
+			e.emit("mov", "x8", num)
+		}
+		e.emit("svc", "#0")
+		e.emit("mov", fr.a64Dst(i.Dst), "x0")
+		e.a64Def(fr, i.Dst)
+
+	case ir.OpJump:
+		e.emit("b", blockLabel(f, i.Targets[0]))
+
+	case ir.OpBranch:
+		cond := e.a64Use(fr, i.Args[0], "x15")
+		e.emit("cbnz", cond, blockLabel(f, i.Targets[0]))
+		e.emit("b", blockLabel(f, i.Targets[1]))
+
+	case ir.OpRet:
+		if len(i.Args) != 0 {
+			src := e.a64Use(fr, i.Args[0], "x15")
+			e.emit("mov", "x0", src)
+		}
+		e.a64Epilogue()
+		e.emit("ret")
+
+	// x30 is restored, the callee returns straight to our caller
+	case ir.OpTailCall:
+		e.a64MoveArgs(fr, i.Args)
+		e.a64Epilogue()
+		e.emit("b", i.Fun)
+
+	default:
+		panic("not implemented")
+	}
+}
@@ -0,0 +1,49 @@
+// This file contains the structured representation of the emitted
+// assembly, so it can be rewritten before printing.
+
+package codegen
+
+import (
+	"strings"
+)
+
+// Operands are in AT&T order, an empty Op means a label
+type instr struct {
+	Op    string
+	Args  []string
+	Label string
+}
+
+type emitter struct {
+	instrs []instr
+}
+
+func (e *emitter) emit(op string, args ...string) {
+	e.instrs = append(e.instrs, instr{Op: op, Args: args})
+}
+
+func (e *emitter) label(name string) {
+	e.instrs = append(e.instrs, instr{Label: name})
+}
+
+func (i *instr) isLabel() bool {
+	return i.Op == ""
+}
+
+func (i *instr) stringify() string {
+	if i.isLabel() {
+		return i.Label + ":\n"
+	}
+	if len(i.Args) == 0 {
+		return "\t" + i.Op + "\n"
+	}
+	return "\t" + i.Op + "\t" + strings.Join(i.Args, ", ") + "\n"
+}
+
+func stringifyInstrs(instrs []instr) string {
+	code := ""
+	for _, i := range instrs {
+		code += i.stringify()
+	}
+	return code
+}
@@ -3,10 +3,9 @@
 package codegen
 
 import (
-	"clic/ast"
-	"clic/symbol"
-	"clic/types"
+	"clic/ir"
 	"fmt"
+	"strings"
 )
 
 // Scratch registers:
@@ -14,6 +13,9 @@ import (
 
 const argRegsCount = 6
 
+// The number of the system call goes in %rax
+var syscallRegs = [...]string{"rdi", "rsi", "rdx", "r10", "r8", "r9"}
+
 var argRegs = [...][argRegsCount]string{
 	1: {"dil", "sil", "dl", "cl", "r8b", "r9b"},
 	2: {"di", "si", "dx", "cx", "r8w", "r9w"},
@@ -21,475 +23,520 @@ var argRegs = [...][argRegsCount]string{
 	8: {"rdi", "rsi", "rdx", "rcx", "r8", "r9"},
 }
 
-var externDecls = ""
+type Target uint
 
-var localCount = 0
+const (
+	TargetX86_64 Target = iota
+	TargetAArch64
+	TargetRISCV64
+)
 
-func Codegen(roots []*ast.Node, t *symbol.Table) string {
-	code := ""
+var targetNames = map[string]Target{
+	"x86_64-linux":  TargetX86_64,
+	"aarch64-linux": TargetAArch64,
+	"riscv64-linux": TargetRISCV64,
+}
 
-	tmp := ""
-	for _, node := range roots {
-		tmp += genNode(node, t)
+func ParseTarget(name string) (Target, error) {
+	target, ok := targetNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown target '%s'", name)
 	}
-
-	code += ".section .text\n"
-	code += ".globl main\n"
-	code += externDecls
-	code += tmp
-
-	return code
+	return target, nil
 }
 
-// Operands are pushed in the reverse order, for example:
-//
-// 3 + 4
-//
-// STACK BASE
-// 4 (rval)
-// 3 (lval)
-func genNode(n *ast.Node, t *symbol.Table) string {
-	code := ""
+type Options struct {
+	Target Target
 
-	switch n.Tag {
-	case ast.NodeScope:
-		for _, node := range n.Scope.Stmts {
-			code += genNode(node, t)
-		}
+	// Without it every temporary lives in the frame
+	Regalloc bool
+	Peephole bool // x86_64 only
 
-	case ast.NodeLVar:
-		sym := t.Get(n.Id)
-		offset := sym.LVar.Offset
-		code += fmt.Sprintf("	movq	-%d(%%rbp), %%rax\n", offset)
-		code += "	pushq	%rax\n"
+	// Adds a '_start' that calls 'main' and exits with its
+	// result, so the program does not need libc
+	Freestanding bool
 
-	case ast.NodeInt:
-		if n.Int.Signed {
-			code += fmt.Sprintf("	pushq	$%d\n", n.Int.SValue)
-		} else {
-			code += fmt.Sprintf("	pushq	$%d\n", n.Int.UValue)
-		}
+	// Position independent code for shared libraries. Only
+	// x86_64 needs it, the calls of the other targets can
+	// already go through the PLT.
+	PIC bool
+}
 
-	case ast.NodeBinOp:
-		code += genBinOp(n, t)
+// Locations of everything that lives in the function frame, shared
+// by the targets
+type frame struct {
+	slots  []uint   // Offsets from the frame pointer
+	regs   []string // Register of every temporary, empty if spilled
+	spills []uint   // Offsets of the spilled temporaries
+	size   uint
+}
 
-	case ast.NodeFunEx:
-		name := t.Get(n.Id).Name
-		externDecls += fmt.Sprintf(".extern %s\n", name)
+func (fr *frame) temp(t ir.Temp) string {
+	if fr.regs[t] != "" {
+		return "%" + fr.regs[t]
+	}
+	return fmt.Sprintf("-%d(%%rbp)", fr.spills[t])
+}
 
-	case ast.NodeFunCall:
-		if len(n.Fun.Args) >= argRegsCount {
-			panic("arguments on stack are not supported yet")
-		}
+func Codegen(p *ir.Program, o Options) string {
+	code := ""
 
-		for i, node := range n.Fun.Args {
-			code += genNode(node, t)
-			code += fmt.Sprintf("	popq	%%%s\n", argRegs[8][i])
+	code += ".section .text\n"
+	for _, f := range p.Funcs {
+		if isExported(f) {
+			code += fmt.Sprintf(".globl %s\n", f.Name)
 		}
+	}
+	if o.Freestanding {
+		code += ".globl _start\n"
+	}
+	for _, ext := range p.Externs {
+		code += fmt.Sprintf(".extern %s\n", ext.Name)
+	}
 
-		name := t.Get(n.Id).Name
-		code += fmt.Sprintf("	call	%s\n", name)
-		code += "	pushq	%rax\n"
+	if o.Freestanding {
+		code += "\n"
+		code += stringifyInstrs(genStart(p, o))
+	}
 
-	case ast.NodeBool:
-		if n.Bool.Value {
-			code += "	pushq	$1\n"
-		} else {
-			code += "	pushq	$0\n"
+	for _, f := range p.Funcs {
+		instrs := []instr{}
+		switch o.Target {
+		case TargetX86_64:
+			instrs = genX86(f, o)
+		case TargetAArch64:
+			instrs = genA64Function(f, o)
+		case TargetRISCV64:
+			instrs = genRVFunction(f, o)
+		default:
+			panic("not implemented")
 		}
+		code += "\n"
+		if isExported(f) {
+			code += fmt.Sprintf(".type %s, %s\n", f.Name, functionType(o.Target))
+		}
+		code += stringifyInstrs(instrs)
+		if isExported(f) {
+			code += fmt.Sprintf(".size %s, .-%s\n", f.Name, f.Name)
+		}
+	}
 
-	case ast.NodeIf:
-		code += genIf(n, t)
-
-	case ast.NodeWhile:
-		code += genWhile(n, t)
-
-	case ast.NodeFor:
-		code += genFor(n, t)
+	// Marks the stack as not executable for the linker
+	code += "\n.section .note.GNU-stack,\"\",%progbits\n"
 
-	case ast.NodeCast:
-		// Right now there are only integer types, so we can
-		// simply push the node's value on stack. This code
-		// only checks for new and unsupported types.
+	return code
+}
 
-		from := n.Cast.What.GetTypeDeep(t)
+// Exported functions are global symbols, other objects can call them
+func isExported(f *ir.Func) bool {
+	return f.Name == "main" || f.Export
+}
 
-		switch from {
-		// Do nothing
-		case types.GetBuiltin(types.S64):
-		case types.GetBuiltin(types.U64):
-		case types.GetBuiltin(types.Bool):
+// '@' starts a comment on aarch64
+func functionType(target Target) string {
+	if target == TargetAArch64 {
+		return "%function"
+	}
+	return "@function"
+}
 
-		case types.GetBuiltin(types.Void):
-			panic("trying to cast from type 'void'")
+// Linux starts the program at '_start' with the stack aligned to 16
+// bytes, the same as right before a call.
+func genStart(p *ir.Program, o Options) []instr {
+	ret := ir.Void
+	for _, f := range p.Funcs {
+		if f.Name == "main" {
+			ret = f.Ret
+		}
+	}
 
+	e := emitter{}
+	e.label("_start")
+
+	switch o.Target {
+	case TargetX86_64:
+		e.emit("xorl", "%ebp", "%ebp") // Marks the outermost frame
+		e.emit("call", "main")
+		switch ret {
+		case ir.Void:
+			e.emit("xorl", "%edi", "%edi")
+		case ir.I1:
+			e.emit("movzbq", "%al", "%rdi")
 		default:
-			panic("not implemented")
+			e.emit("movq", "%rax", "%rdi")
 		}
-
-		code += genNode(n.Cast.What, t)
-
-	case ast.NodeFunDef:
-		code += genFunction(n, t)
-
-	case ast.NodeReturn:
-		code += genNode(n.Return.Val, t)
-		code += "	popq	%rax\n"
-		code += "	movq	%rbp, %rsp\n"
-		code += "	popq	%rbp\n"
-		code += "	ret\n"
-
-	// Do nothing
-	case ast.NodeTypedef:
-	case ast.NodeEmpty:
-	case ast.NodeLVarDecl:
-	case ast.NodeFunDecl:
+		e.emit("movl", "$60", "%eax")
+		e.emit("syscall")
+
+	case TargetAArch64:
+		e.emit("mov", "x29", "#0")
+		e.emit("mov", "x30", "#0")
+		e.emit("bl", "main")
+		switch ret {
+		case ir.Void:
+			e.emit("mov", "x0", "#0")
+		case ir.I1:
+			e.emit("and", "x0", "x0", "#0xff")
+		}
+		e.emit("mov", "x8", "#93")
+		e.emit("svc", "#0")
+
+	case TargetRISCV64:
+		e.emit("li", "s0", "0")
+		e.emit("call", "main")
+		switch ret {
+		case ir.Void:
+			e.emit("li", "a0", "0")
+		case ir.I1:
+			e.emit("andi", "a0", "a0", "0xff")
+		}
+		e.emit("li", "a7", "93")
+		e.emit("ecall")
 
 	default:
 		panic("not implemented")
 	}
 
-	return code
+	return e.instrs
 }
 
-func genBinOp(n *ast.Node, t *symbol.Table) string {
-	code := ""
-
-	lval := genNode(n.BinOp.Lval, t)
-	rval := genNode(n.BinOp.Rval, t)
-
-	switch n.BinOp.Tag {
-	case ast.BinOpAssign:
-		sym := t.Get(n.BinOp.Lval.Id)
+func genX86(f *ir.Func, o Options) []instr {
+	instrs := genFunction(f, o)
+	if o.Peephole {
+		instrs = peephole(instrs)
+	}
+	if o.PIC {
+		pltCalls(instrs)
+	}
+	return instrs
+}
 
-		if sym.Tag == symbol.LVar {
-			offset := sym.LVar.Offset
-			code += rval
-			code += "	popq	%rax\n"
-			code += fmt.Sprintf("	movq	%%rax, -%d(%%rbp)\n", offset)
-		} else {
-			panic("not implemented")
+// Functions may be in another object, so calls to them go through
+// the PLT. The linker makes the calls to local functions direct
+// again.
+func pltCalls(instrs []instr) {
+	for k := range instrs {
+		i := &instrs[k]
+		if i.Op == "call" || (i.Op == "jmp" && !strings.HasPrefix(i.Args[0], ".L")) {
+			i.Args = []string{i.Args[0] + "@PLT"}
 		}
+	}
+}
 
-	case ast.BinOpArith:
-		switch n.BinOp.ArithTag {
-		case ast.BinOpSum:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-			code += "	addq	%rdi, %rax\n"
-			code += "	pushq	%rax\n"
-
-		case ast.BinOpSub:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-			code += "	subq	%rdi, %rax\n"
-			code += "	pushq	%rax\n"
-
-		case ast.BinOpMult:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-			code += "	imulq	%rdi, %rax\n"
-			// TODO: The result is actually stored in
-			// [rdx:rax], is this ok to do?
-			code += "	pushq	%rax\n"
-
-		case ast.BinOpDiv:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-
-			// R[%rax] <- R[%rdx]:R[%rax] / S
-
-			code += "	cqto\n" // sign extend rax to [rdx:rax]
-			code += "	idivq	%rdi\n"
-			code += "	pushq	%rax\n"
-
-		case ast.BinOpMod:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-
-			// R[%rdx] <- R[%rdx]:R[%rax] mod S
-
-			code += "	cqto\n" // sign extend rax to [rdx:rax]
-			code += "	idivq	%rdi\n"
-			code += "	pushq	%rdx\n"
-
-		default:
-			panic("not implemented")
-		}
+// Spilled temporaries get their own place in the frame after the
+// slots.
+func setVarOffsets(f *ir.Func, regs []string) frame {
+	fr := frame{}
+	reserv := uint(0)
 
-	case ast.BinOpComp:
-		switch n.BinOp.CompTag {
-		case ast.BinOpEq:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-			code += "	xorq	%rsi, %rsi\n"
-			code += "	cmpq	%rdi, %rax\n"
-			code += "	sete	%sil\n"
-			code += "	pushq	%rsi\n"
-
-		case ast.BinOpNeq:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-			code += "	xorq	%rsi, %rsi\n"
-			code += "	cmpq	%rdi, %rax\n"
-			code += "	setne	%sil\n"
-			code += "	pushq	%rsi\n"
-
-		case ast.BinOpLessEq:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-			code += "	xorq	%rsi, %rsi\n"
-			code += "	cmpq	%rdi, %rax\n"
-			code += "	setle	%sil\n"
-			code += "	pushq	%rsi\n"
-
-		case ast.BinOpLess:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-			code += "	xorq	%rsi, %rsi\n"
-			code += "	cmpq	%rdi, %rax\n"
-			code += "	setl	%sil\n"
-			code += "	pushq	%rsi\n"
-
-		case ast.BinOpGreatEq:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-			code += "	xorq	%rsi, %rsi\n"
-			code += "	cmpq	%rdi, %rax\n"
-			code += "	setge	%sil\n"
-			code += "	pushq	%rsi\n"
-
-		case ast.BinOpGreat:
-			code += rval
-			code += lval
-			code += "	popq	%rax\n" // lval
-			code += "	popq	%rdi\n" // rval
-			code += "	xorq	%rsi, %rsi\n"
-			code += "	cmpq	%rdi, %rax\n"
-			code += "	setg	%sil\n"
-			code += "	pushq	%rsi\n"
+	for _, slot := range f.Slots {
+		size := slot.Type.Size()
+		reserv += size
+		reserv += (size - (reserv % size)) % size
+		fr.slots = append(fr.slots, reserv)
+	}
 
-		default:
-			panic("not implemented")
+	reserv += (8 - (reserv % 8)) % 8
+	fr.regs = regs
+	fr.spills = make([]uint, len(regs))
+	for t, reg := range regs {
+		if reg == "" {
+			reserv += 8
+			fr.spills[t] = reserv
 		}
-
-	default:
-		panic("not implemented")
 	}
 
-	return code
+	reserv += (16 - (reserv % 16)) % 16
+	fr.size = reserv
+
+	return fr
 }
 
-func genIf(n *ast.Node, t *symbol.Table) string {
-	code := ""
+func blockLabel(f *ir.Func, id ir.BlockId) string {
+	return fmt.Sprintf(".L%s_%d", f.Name, id)
+}
 
-	code += genNode(n.If.Exp, t)
+var movBySize = [...]string{
+	1: "movb",
+	2: "movw",
+	4: "movl",
+	8: "movq",
+}
 
-	code += "	popq	%rax\n"
-	code += "	cmpq	$0, %rax\n"
+func genFunction(f *ir.Func, o Options) []instr {
+	e := emitter{}
 
-	// End of the entire if/else block.
-	end := fmt.Sprintf(".L%d", localCount)
-	localCount += 1
+	regs := make([]string, len(f.Temps))
+	if o.Regalloc {
+		regs = allocRegisters(f, allocRegs)
+	}
+	fr := setVarOffsets(f, regs)
 
-	if len(n.If.ElseStmts) == 0 {
-		code += fmt.Sprintf("	je	%s\n", end)
-		for _, stmt := range n.If.IfStmts {
-			code += genNode(stmt, t)
-		}
-	} else {
-		elseStart := fmt.Sprintf(".L%d", localCount)
-		localCount += 1
+	e.label(f.Name)
+	e.emit("pushq", "%rbp")
+	e.emit("movq", "%rsp", "%rbp")
+	e.emit("subq", fmt.Sprintf("$%d", fr.size), "%rsp")
 
-		code += fmt.Sprintf("	je	%s\n", elseStart)
-		for _, stmt := range n.If.IfStmts {
-			code += genNode(stmt, t)
-		}
-		code += fmt.Sprintf("	jmp	%s\n", end)
-		code += fmt.Sprintf("%s:\n", elseStart)
-		for _, stmt := range n.If.ElseStmts {
-			code += genNode(stmt, t)
+	if len(f.Params) > argRegsCount {
+		panic("arguments on stack are not supported yet")
+	}
+	for i, slot := range f.Params {
+		size := f.Slots[slot].Type.Size()
+		e.emit(movBySize[size], "%"+argRegs[size][i], fmt.Sprintf("-%d(%%rbp)", fr.slots[slot]))
+	}
+
+	for id, block := range f.Blocks {
+		e.label(blockLabel(f, ir.BlockId(id)))
+		for _, instr := range block.Instrs {
+			e.genInstr(f, &fr, &instr)
 		}
 	}
 
-	code += fmt.Sprintf("%s:\n", end)
+	return e.instrs
+}
 
-	return code
+func isReg(loc string) bool {
+	return loc[0] == '%'
 }
 
-func genWhile(n *ast.Node, t *symbol.Table) string {
-	code := ""
+// Memory to memory moves go through %rax
+func (e *emitter) move(src string, dst string) {
+	if src == dst {
+		return
+	}
+	if !isReg(src) && !isReg(dst) {
+		e.emit("movq", src, "%rax")
+		e.emit("movq", "%rax", dst)
+		return
+	}
+	e.emit("movq", src, dst)
+}
 
-	start := fmt.Sprintf(".L%d", localCount)
-	localCount += 1
-	end := fmt.Sprintf(".L%d", localCount)
-	localCount += 1
-
-	code += fmt.Sprintf("%s:\n", start)
-	code += genNode(n.While.Exp, t)
-	code += "	popq	%rax\n"
-	code += "	cmpq	$0, %rax\n"
-	code += fmt.Sprintf("	jz	%s\n", end)
-	for _, stmt := range n.While.Stmts {
-		code += genNode(stmt, t)
+// Moves every source to its destination register as if all moves
+// happened at once. Destinations are never %rax, so it is used to
+// break cycles.
+func (e *emitter) parallelMove(srcs []string, dsts []string) {
+	pending := []int{}
+	for i := range srcs {
+		if srcs[i] != dsts[i] {
+			pending = append(pending, i)
+		}
 	}
-	code += fmt.Sprintf("	jmp	%s\n", start)
-	code += fmt.Sprintf("%s:\n", end)
 
-	return code
+	for len(pending) > 0 {
+		progress := false
+
+		for k, i := range pending {
+			blocked := false
+			for _, j := range pending {
+				if j != i && srcs[j] == dsts[i] {
+					blocked = true
+					break
+				}
+			}
+
+			if !blocked {
+				e.move(srcs[i], dsts[i])
+				pending = append(pending[:k], pending[k+1:]...)
+				progress = true
+				break
+			}
+		}
+
+		if !progress {
+			i := pending[0]
+			e.move(srcs[i], "%rax")
+			srcs[i] = "%rax"
+		}
+	}
 }
 
-func genFor(n *ast.Node, t *symbol.Table) string {
-	code := ""
+func (e *emitter) moveArgs(args []string) {
+	if len(args) > argRegsCount {
+		panic("arguments on stack are not supported yet")
+	}
 
-	start := fmt.Sprintf(".L%d", localCount)
-	localCount += 1
-	end := fmt.Sprintf(".L%d", localCount)
-	localCount += 1
-
-	code += genNode(n.For.Init, t)
-	code += fmt.Sprintf("%s:\n", start)
-	code += genNode(n.For.Cond, t)
-	code += "	popq	%rax\n"
-	code += "	cmpq	$0, %rax\n"
-	code += fmt.Sprintf("	jz	%s\n", end)
-	for _, stmt := range n.For.Stmts {
-		code += genNode(stmt, t)
+	dsts := []string{}
+	for j := range args {
+		dsts = append(dsts, "%"+argRegs[8][j])
 	}
-	code += genNode(n.For.Adv, t)
-	code += fmt.Sprintf("	jmp	%s\n", start)
-	code += fmt.Sprintf("%s:\n", end)
+	e.parallelMove(args, dsts)
+}
 
-	return code
+// Condition codes of comparisons, used by 'set' and 'j'
+var condCodes = map[ir.Op]string{
+	ir.OpEq:  "e",
+	ir.OpNe:  "ne",
+	ir.OpSLt: "l",
+	ir.OpSLe: "le",
+	ir.OpSGt: "g",
+	ir.OpSGe: "ge",
+	ir.OpULt: "b",
+	ir.OpULe: "be",
+	ir.OpUGt: "a",
+	ir.OpUGe: "ae",
 }
 
-func setVarOffsets(n *ast.Node, t *symbol.Table, reserv uint) uint {
-	switch n.Tag {
-	case ast.NodeScope:
-		for _, stmt := range n.Scope.Stmts {
-			reserv = setVarOffsets(stmt, t, reserv)
-		}
+var arithInstrs = map[ir.Op]string{
+	ir.OpAdd: "addq",
+	ir.OpSub: "subq",
+	ir.OpMul: "imulq",
+}
 
-	case ast.NodeLVarDecl:
-		sym := t.Get(n.Id)
-		size := types.Get(sym.Type).Size
-		sym.LVar.Offset = reserv + size
-		reserv += size
-		t.Set(n.Id, sym)
+func (e *emitter) genInstr(f *ir.Func, fr *frame, i *ir.Instr) {
+	dst := ""
+	if i.Dst != ir.TempNone {
+		dst = fr.temp(i.Dst)
+	}
+	args := []string{}
+	for _, arg := range i.Args {
+		args = append(args, fr.temp(arg))
+	}
 
-	case ast.NodeBinOp:
-		reserv = setVarOffsets(n.BinOp.Lval, t, reserv)
-		reserv = setVarOffsets(n.BinOp.Rval, t, reserv)
+	// Register to compute the result in
+	work := dst
+	if dst == "" || !isReg(dst) {
+		work = "%rax"
+	}
 
-	case ast.NodeFunCall:
-		for _, arg := range n.Fun.Args {
-			reserv = setVarOffsets(arg, t, reserv)
+	switch i.Op {
+	case ir.OpConst:
+		imm := fmt.Sprintf("$%d", i.Imm)
+		if i.Imm == int64(int32(i.Imm)) {
+			e.emit("movq", imm, dst)
+		} else {
+			e.emit("movabsq", imm, work)
+			e.move(work, dst)
 		}
 
-	case ast.NodeIf:
-		reserv = setVarOffsets(n.If.Exp, t, reserv)
-		for _, stmt := range n.If.IfStmts {
-			reserv = setVarOffsets(stmt, t, reserv)
+	case ir.OpLoad:
+		offset := fmt.Sprintf("-%d(%%rbp)", fr.slots[i.Slot])
+		switch i.Type {
+		case ir.I1:
+			e.emit("movzbq", offset, work)
+		case ir.I64:
+			e.emit("movq", offset, work)
+		default:
+			panic("not implemented")
 		}
-		for _, stmt := range n.If.ElseStmts {
-			reserv = setVarOffsets(stmt, t, reserv)
+		e.move(work, dst)
+
+	case ir.OpStore:
+		offset := fmt.Sprintf("-%d(%%rbp)", fr.slots[i.Slot])
+		src := args[0]
+		if !isReg(src) {
+			e.move(src, "%rax")
+			src = "%rax"
 		}
-
-	case ast.NodeWhile:
-		reserv = setVarOffsets(n.While.Exp, t, reserv)
-		for _, stmt := range n.While.Stmts {
-			reserv = setVarOffsets(stmt, t, reserv)
+		switch i.Type {
+		case ir.I1:
+			e.emit("movb", "%"+byteRegs[src[1:]], offset)
+		case ir.I64:
+			e.emit("movq", src, offset)
+		default:
+			panic("not implemented")
 		}
 
-	case ast.NodeFor:
-		reserv = setVarOffsets(n.For.Init, t, reserv)
-		reserv = setVarOffsets(n.For.Cond, t, reserv)
-		reserv = setVarOffsets(n.For.Adv, t, reserv)
-		for _, stmt := range n.For.Stmts {
-			reserv = setVarOffsets(stmt, t, reserv)
-		}
+	// Bools are kept zero extended, so this is a copy
+	case ir.OpCopy, ir.OpZext:
+		e.move(args[0], dst)
 
-	case ast.NodeCast:
-		reserv = setVarOffsets(n.Cast.What, t, reserv)
+	// The result never shares a register with an operand, so
+	// 'work' can be overwritten before reading the second one.
+	case ir.OpAdd, ir.OpSub, ir.OpMul:
+		e.move(args[0], work)
+		e.emit(arithInstrs[i.Op], args[1], work)
+		e.move(work, dst)
 
-	case ast.NodeFunDef:
-		for _, stmt := range n.Fun.Stmts {
-			reserv = setVarOffsets(stmt, t, reserv)
-		}
+	case ir.OpSDiv, ir.OpSRem, ir.OpUDiv, ir.OpURem:
+		e.move(args[0], "%rax")
 
-	case ast.NodeReturn:
-		reserv = setVarOffsets(n.Return.Val, t, reserv)
+		// R[%rax] <- R[%rdx]:R[%rax] / S
+		// R[%rdx] <- R[%rdx]:R[%rax] mod S
 
-	case ast.NodeInt:
-	case ast.NodeLVar:
-	case ast.NodeFunEx:
-	case ast.NodeBool:
-	case ast.NodeTypedef:
-	case ast.NodeEmpty:
-
-	default:
-		panic("not implemented")
-	}
-
-	return reserv
-}
+		if i.Op == ir.OpSDiv || i.Op == ir.OpSRem {
+			e.emit("cqto") // sign extend rax to [rdx:rax]
+			e.emit("idivq", args[1])
+		} else {
+			e.emit("xorl", "%edx", "%edx")
+			e.emit("divq", args[1])
+		}
 
-func genFunction(n *ast.Node, t *symbol.Table) string {
-	code := ""
-	reserv := uint(0)
+		if i.Op == ir.OpSDiv || i.Op == ir.OpUDiv {
+			e.move("%rax", dst)
+		} else {
+			e.move("%rdx", dst)
+		}
 
-	code += "\n"
-	code += t.Get(n.Id).Name + ":\n"
-	code += "	pushq	%rbp\n"
-	code += "	movq	%rsp, %rbp\n"
+	case ir.OpEq, ir.OpNe, ir.OpSLt, ir.OpSLe, ir.OpSGt, ir.OpSGe,
+		ir.OpULt, ir.OpULe, ir.OpUGt, ir.OpUGe:
+		lval := args[0]
+		if !isReg(lval) && !isReg(args[1]) {
+			e.move(lval, "%rax")
+			lval = "%rax"
+		}
+		e.emit("cmpq", args[1], lval)
+		e.emit("set"+condCodes[i.Op], "%al")
+		e.emit("movzbq", "%al", work)
+		e.move(work, dst)
+
+	case ir.OpCall:
+		e.moveArgs(args)
+		e.emit("call", i.Fun)
+
+		if dst != "" {
+			// Only the low byte is defined for bools
+			if i.Type == ir.I1 {
+				e.emit("movzbq", "%al", "%rax")
+			}
+			e.move("%rax", dst)
+		}
 
-	for i, param := range n.Fun.Params {
-		sym := t.Get(param)
-		if sym.Tag != symbol.LVar {
-			panic("param != local var")
+	// The number is moved along with the arguments, through
+	// %r11 since the kernel clobbers it anyway
+	case ir.OpSyscall:
+		if len(args) > len(syscallRegs)+1 {
+			panic("too many syscall arguments")
 		}
 
-		typeNode := types.Get(sym.Type)
-		size := typeNode.Size
+		srcs := append([]string{}, args[1:]...)
+		dsts := []string{}
+		for j := range srcs {
+			dsts = append(dsts, "%"+syscallRegs[j])
+		}
+		srcs = append(srcs, args[0])
+		dsts = append(dsts, "%r11")
+		e.parallelMove(srcs, dsts)
 
-		sym.LVar.Offset = reserv + size
-		reserv += size
-		t.Set(param, sym)
+		e.emit("movq", "%r11", "%rax")
+		e.emit("syscall")
+		e.move("%rax", dst)
 
-		code += fmt.Sprintf("	mov	%%%s, -%d(%%rbp)\n",
-			argRegs[size][i], sym.LVar.Offset)
-	}
-	reserv = setVarOffsets(n, t, reserv)
-	reserv += (16 - (reserv % 16)) % 16
-	code += fmt.Sprintf("	subq	$%d, %%rsp\n", reserv)
+	case ir.OpJump:
+		e.emit("jmp", blockLabel(f, i.Targets[0]))
 
-	for _, stmt := range n.Fun.Stmts {
-		code += genNode(stmt, t)
-	}
+	case ir.OpBranch:
+		e.emit("cmpq", "$0", args[0])
+		e.emit("jne", blockLabel(f, i.Targets[0]))
+		e.emit("jmp", blockLabel(f, i.Targets[1]))
 
-	code += "	movq	%rbp, %rsp\n"
-	code += "	popq	%rbp\n"
-	code += "	ret\n"
+	case ir.OpRet:
+		if len(args) != 0 {
+			e.move(args[0], "%rax")
+		}
+		e.emit("movq", "%rbp", "%rsp")
+		e.emit("popq", "%rbp")
+		e.emit("ret")
+
+	// The arguments are in registers, so the frame can go before
+	// jumping. The callee returns straight to our caller.
+	case ir.OpTailCall:
+		e.moveArgs(args)
+		e.emit("movq", "%rbp", "%rsp")
+		e.emit("popq", "%rbp")
+		e.emit("jmp", i.Fun)
 
-	return code
+	default:
+		panic("not implemented")
+	}
 }
@@ -0,0 +1,398 @@
+// This file contains the x86_64 instruction encoder, it turns the
+// instructions of the x86_64 codegen into machine code without an
+// external assembler.
+
+package codegen
+
+import (
+	"clic/elf"
+	"clic/ir"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type operandKind uint
+
+const (
+	operandReg operandKind = iota
+	operandMem
+	operandImm
+	operandSym
+)
+
+type operand struct {
+	kind operandKind
+	reg  int    // Register, or base register of memory
+	size int    // Of registers, in bytes
+	disp int64  // Displacement of memory, or the immediate
+	sym  string // Label or symbol
+}
+
+var regNames = [...][16]string{
+	1: {"al", "cl", "dl", "bl", "spl", "bpl", "sil", "dil",
+		"r8b", "r9b", "r10b", "r11b", "r12b", "r13b", "r14b", "r15b"},
+	2: {"ax", "cx", "dx", "bx", "sp", "bp", "si", "di",
+		"r8w", "r9w", "r10w", "r11w", "r12w", "r13w", "r14w", "r15w"},
+	4: {"eax", "ecx", "edx", "ebx", "esp", "ebp", "esi", "edi",
+		"r8d", "r9d", "r10d", "r11d", "r12d", "r13d", "r14d", "r15d"},
+	8: {"rax", "rcx", "rdx", "rbx", "rsp", "rbp", "rsi", "rdi",
+		"r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15"},
+}
+
+var regOperands = map[string]operand{}
+
+func init() {
+	for size, names := range regNames {
+		for num, name := range names {
+			if name != "" {
+				regOperands[name] = operand{kind: operandReg, reg: num, size: size}
+			}
+		}
+	}
+}
+
+// Parses AT&T operands: %reg, $imm, disp(%reg) and symbols
+func parseOperand(s string) operand {
+	switch {
+	case s[0] == '%':
+		reg, ok := regOperands[s[1:]]
+		if !ok {
+			panic(fmt.Sprintf("unknown register '%s'", s))
+		}
+		return reg
+
+	case s[0] == '$':
+		imm, err := strconv.ParseInt(s[1:], 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		return operand{kind: operandImm, disp: imm}
+
+	case strings.HasSuffix(s, ")"):
+		open := strings.IndexByte(s, '(')
+		disp := int64(0)
+		if open > 0 {
+			var err error
+			disp, err = strconv.ParseInt(s[:open], 10, 32)
+			if err != nil {
+				panic(err)
+			}
+		}
+		base := parseOperand(s[open+1 : len(s)-1])
+		return operand{kind: operandMem, reg: base.reg, disp: disp}
+
+	default:
+		return operand{kind: operandSym, sym: s}
+	}
+}
+
+// spl, bpl, sil and dil are only reachable with a REX prefix
+func (op operand) needsRex() bool {
+	return op.kind == operandReg && op.size == 1 && op.reg >= 4 && op.reg < 8
+}
+
+var condNumbers = map[string]byte{
+	"b": 0x2, "ae": 0x3, "e": 0x4, "ne": 0x5, "be": 0x6, "a": 0x7,
+	"l": 0xc, "ge": 0xd, "le": 0xe, "g": 0xf,
+}
+
+// Opcode extension in ModRM.reg for the group 1 instructions with an
+// immediate, and the opcode with a register as source
+var aluOps = map[string]struct {
+	ext   int
+	store byte // op r/m, reg
+	load  byte // op reg, r/m
+}{
+	"add": {0, 0x01, 0x03},
+	"sub": {5, 0x29, 0x2b},
+	"xor": {6, 0x31, 0x33},
+	"cmp": {7, 0x39, 0x3b},
+}
+
+// Reference to a label, the 32 bit field at 'offset' gets the
+// distance from the end of the field
+type fixup struct {
+	offset int
+	label  string
+}
+
+type encoder struct {
+	code   []byte
+	labels map[string]int
+	fixups []fixup
+}
+
+func (enc *encoder) bytes(b ...byte) {
+	enc.code = append(enc.code, b...)
+}
+
+func (enc *encoder) imm32(v int64) {
+	enc.code = binary.LittleEndian.AppendUint32(enc.code, uint32(v))
+}
+
+func (enc *encoder) rel32(label string) {
+	enc.fixups = append(enc.fixups, fixup{offset: len(enc.code), label: label})
+	enc.imm32(0)
+}
+
+// Writes an instruction with a ModRM byte. 'reg' is a register or
+// an opcode extension.
+func (enc *encoder) modrm(size int, opcode []byte, reg int, rm operand, rex bool) {
+	if size == 2 {
+		enc.bytes(0x66)
+	}
+
+	prefix := byte(0x40)
+	if size == 8 {
+		prefix |= 0x8
+	}
+	if reg >= 8 {
+		prefix |= 0x4
+	}
+	if rm.reg >= 8 {
+		prefix |= 0x1
+	}
+	if prefix != 0x40 || rex || rm.needsRex() {
+		enc.bytes(prefix)
+	}
+	enc.bytes(opcode...)
+
+	if rm.kind == operandReg {
+		enc.bytes(0xc0 | byte(reg&7)<<3 | byte(rm.reg&7))
+		return
+	}
+
+	// Base rbp and r13 need a displacement even when it is 0,
+	// base rsp and r12 need a SIB byte
+	mod := byte(0x80)
+	if rm.disp == 0 && rm.reg&7 != 5 {
+		mod = 0x00
+	} else if rm.disp == int64(int8(rm.disp)) {
+		mod = 0x40
+	}
+	enc.bytes(mod | byte(reg&7)<<3 | byte(rm.reg&7))
+	if rm.reg&7 == 4 {
+		enc.bytes(0x24)
+	}
+
+	switch mod {
+	case 0x40:
+		enc.bytes(byte(rm.disp))
+	case 0x80:
+		enc.imm32(rm.disp)
+	}
+}
+
+// Returns the operand size from the suffix of the mnemonic
+func suffixSize(op string) int {
+	switch op[len(op)-1] {
+	case 'b':
+		return 1
+	case 'w':
+		return 2
+	case 'l':
+		return 4
+	case 'q':
+		return 8
+	default:
+		panic(fmt.Sprintf("no size suffix in '%s'", op))
+	}
+}
+
+func (enc *encoder) encode(i *instr) {
+	if i.isLabel() {
+		enc.labels[i.Label] = len(enc.code)
+		return
+	}
+
+	args := []operand{}
+	for _, arg := range i.Args {
+		args = append(args, parseOperand(arg))
+	}
+
+	switch {
+	case i.Op == "ret":
+		enc.bytes(0xc3)
+
+	case i.Op == "cqto":
+		enc.bytes(0x48, 0x99)
+
+	case i.Op == "syscall":
+		enc.bytes(0x0f, 0x05)
+
+	case i.Op == "pushq" || i.Op == "popq":
+		opcode := byte(0x50)
+		if i.Op == "popq" {
+			opcode = 0x58
+		}
+		if args[0].reg >= 8 {
+			enc.bytes(0x41)
+		}
+		enc.bytes(opcode + byte(args[0].reg&7))
+
+	// Calls to other objects are always relocated against the PLT
+	case i.Op == "call":
+		enc.bytes(0xe8)
+		enc.rel32(strings.TrimSuffix(i.Args[0], "@PLT"))
+
+	case i.Op == "jmp":
+		enc.bytes(0xe9)
+		enc.rel32(strings.TrimSuffix(i.Args[0], "@PLT"))
+
+	case i.Op[0] == 'j':
+		enc.bytes(0x0f, 0x80|condNumbers[i.Op[1:]])
+		enc.rel32(i.Args[0])
+
+	case strings.HasPrefix(i.Op, "set"):
+		enc.modrm(1, []byte{0x0f, 0x90 | condNumbers[i.Op[3:]]}, 0, args[0], false)
+
+	case i.Op == "movabsq":
+		dst := args[1]
+		prefix := byte(0x48)
+		if dst.reg >= 8 {
+			prefix |= 0x1
+		}
+		enc.bytes(prefix, 0xb8+byte(dst.reg&7))
+		enc.code = binary.LittleEndian.AppendUint64(enc.code, uint64(args[0].disp))
+
+	case i.Op == "movzbq":
+		enc.modrm(8, []byte{0x0f, 0xb6}, args[1].reg, args[0], false)
+
+	case i.Op == "imulq":
+		enc.modrm(8, []byte{0x0f, 0xaf}, args[1].reg, args[0], false)
+
+	case i.Op == "idivq" || i.Op == "divq":
+		ext := 6
+		if i.Op == "idivq" {
+			ext = 7
+		}
+		enc.modrm(8, []byte{0xf7}, ext, args[0], false)
+
+	case strings.HasPrefix(i.Op, "mov"):
+		enc.encodeMov(suffixSize(i.Op), args[0], args[1])
+
+	default:
+		alu, ok := aluOps[i.Op[:len(i.Op)-1]]
+		if !ok {
+			panic(fmt.Sprintf("can't encode '%s'", i.Op))
+		}
+		enc.encodeALU(suffixSize(i.Op), alu.ext, alu.store, alu.load, args[0], args[1])
+	}
+}
+
+func (enc *encoder) encodeMov(size int, src operand, dst operand) {
+	opcode := byte(0x89)
+	if size == 1 {
+		opcode = 0x88
+	}
+
+	switch {
+	case src.kind == operandImm:
+		if size != 8 && size != 4 {
+			panic("not implemented")
+		}
+		enc.modrm(size, []byte{0xc7}, 0, dst, false)
+		enc.imm32(src.disp)
+
+	case src.kind == operandReg:
+		enc.modrm(size, []byte{opcode}, src.reg, dst, src.needsRex())
+
+	case dst.kind == operandReg:
+		enc.modrm(size, []byte{opcode + 2}, dst.reg, src, dst.needsRex())
+
+	default:
+		panic("memory to memory move")
+	}
+}
+
+// AT&T 'op src, dst' computes 'dst op src'
+func (enc *encoder) encodeALU(size int, ext int, store byte, load byte, src operand, dst operand) {
+	switch {
+	case src.kind == operandImm && src.disp == int64(int8(src.disp)):
+		enc.modrm(size, []byte{0x83}, ext, dst, false)
+		enc.bytes(byte(src.disp))
+
+	case src.kind == operandImm:
+		enc.modrm(size, []byte{0x81}, ext, dst, false)
+		enc.imm32(src.disp)
+
+	case src.kind == operandReg:
+		enc.modrm(size, []byte{store}, src.reg, dst, false)
+
+	case dst.kind == operandReg:
+		enc.modrm(size, []byte{load}, dst.reg, src, false)
+
+	default:
+		panic("memory to memory operation")
+	}
+}
+
+// Returns an x86_64 ELF relocatable object of the program. Calls to
+// functions that are not in it are relocated against their symbol.
+func Object(p *ir.Program, o Options) []byte {
+	if o.Target != TargetX86_64 {
+		panic("object files are only supported for x86_64")
+	}
+
+	enc := encoder{labels: make(map[string]int)}
+	obj := elf.Object{}
+
+	if o.Freestanding {
+		for _, i := range genStart(p, o) {
+			enc.encode(&i)
+		}
+		obj.Symbols = append(obj.Symbols, elf.Symbol{
+			Name:    "_start",
+			Section: elf.SectionText,
+			Size:    uint64(len(enc.code)),
+			Func:    true,
+			Global:  true,
+		})
+	}
+
+	for _, f := range p.Funcs {
+		start := len(enc.code)
+		for _, i := range genX86(f, o) {
+			enc.encode(&i)
+		}
+		obj.Symbols = append(obj.Symbols, elf.Symbol{
+			Name:    f.Name,
+			Section: elf.SectionText,
+			Value:   uint64(start),
+			Size:    uint64(len(enc.code) - start),
+			Func:    true,
+			Global:  isExported(f),
+		})
+	}
+
+	undefined := map[string]bool{}
+	for _, ext := range p.Externs {
+		obj.Symbols = append(obj.Symbols, elf.Symbol{Name: ext.Name, Global: true})
+		undefined[ext.Name] = true
+	}
+
+	// Functions that are only declared are defined by another
+	// object, like the external ones
+	for _, fix := range enc.fixups {
+		target, ok := enc.labels[fix.label]
+		if !ok {
+			if !undefined[fix.label] {
+				obj.Symbols = append(obj.Symbols, elf.Symbol{Name: fix.label, Global: true})
+				undefined[fix.label] = true
+			}
+			obj.Relocs = append(obj.Relocs, elf.Reloc{
+				Offset: uint64(fix.offset),
+				Symbol: fix.label,
+				Type:   elf.RelocPLT32,
+				Addend: -4,
+			})
+			continue
+		}
+		binary.LittleEndian.PutUint32(enc.code[fix.offset:], uint32(target-(fix.offset+4)))
+	}
+
+	obj.Text = enc.code
+	return obj.Bytes()
+}
@@ -0,0 +1,137 @@
+// This file contains the peephole optimizer for the emitted
+// instructions.
+
+package codegen
+
+import (
+	"strings"
+)
+
+var invertedCond = map[string]string{
+	"e":  "ne",
+	"ne": "e",
+	"l":  "ge",
+	"ge": "l",
+	"le": "g",
+	"g":  "le",
+	"b":  "ae",
+	"ae": "b",
+	"be": "a",
+	"a":  "be",
+}
+
+// Returns the condition code of a conditional jump, or an empty
+// string for anything else.
+func jumpCond(i *instr) string {
+	if i.isLabel() || i.Op == "jmp" || !strings.HasPrefix(i.Op, "j") {
+		return ""
+	}
+	cond := i.Op[1:]
+	if _, ok := invertedCond[cond]; !ok {
+		return ""
+	}
+	return cond
+}
+
+// Applies the rules until nothing changes
+func peephole(instrs []instr) []instr {
+	for {
+		changed := false
+		instrs, changed = peepholeOnce(instrs)
+		if !changed {
+			return instrs
+		}
+	}
+}
+
+func peepholeOnce(in []instr) ([]instr, bool) {
+	out := []instr{}
+	changed := false
+
+	for i := 0; i < len(in); i++ {
+		cur := in[i]
+
+		// movq X, X
+		if cur.Op == "movq" && cur.Args[0] == cur.Args[1] {
+			changed = true
+			continue
+		}
+
+		// addq $0, X
+		if (cur.Op == "addq" || cur.Op == "subq") && cur.Args[0] == "$0" {
+			changed = true
+			continue
+		}
+
+		if i+1 < len(in) {
+			next := in[i+1]
+
+			// movq X, Y
+			// movq Y, X
+			if cur.Op == "movq" && next.Op == "movq" &&
+				cur.Args[0] == next.Args[1] && cur.Args[1] == next.Args[0] {
+				out = append(out, cur)
+				i += 1
+				changed = true
+				continue
+			}
+		}
+
+		// jmp L
+		// L:
+		if cur.Op == "jmp" {
+			toNext := false
+			for j := i + 1; j < len(in) && in[j].isLabel(); j++ {
+				if in[j].Label == cur.Args[0] {
+					toNext = true
+				}
+			}
+			if toNext {
+				changed = true
+				continue
+			}
+		}
+
+		// jCC T
+		// jmp E
+		// T:
+		if cond := jumpCond(&cur); cond != "" && i+2 < len(in) &&
+			in[i+1].Op == "jmp" && in[i+2].isLabel() && in[i+2].Label == cur.Args[0] {
+			out = append(out, instr{Op: "j" + invertedCond[cond], Args: in[i+1].Args})
+			i += 1
+			changed = true
+			continue
+		}
+
+		// setCC %al
+		// movzbq %al, R
+		// cmpq $0, R
+		// jne T
+		//
+		// The branch ends the block and R is a temporary, so R
+		// is dead after it.
+		if strings.HasPrefix(cur.Op, "set") && i+4 < len(in) {
+			cond := cur.Op[3:]
+			ext, cmp, jump, after := in[i+1], in[i+2], in[i+3], in[i+4]
+
+			matches := ext.Op == "movzbq" && ext.Args[0] == "%al" &&
+				cmp.Op == "cmpq" && cmp.Args[0] == "$0" && cmp.Args[1] == ext.Args[1] &&
+				(jump.Op == "jne" || jump.Op == "je") &&
+				(after.Op == "jmp" || after.isLabel())
+
+			if matches {
+				if jump.Op == "je" {
+					cond = invertedCond[cond]
+				}
+				out = append(out, instr{Op: "j" + cond, Args: jump.Args})
+				i += 3
+				changed = true
+				continue
+			}
+		}
+
+		out = append(out, cur)
+	}
+
+	return out, changed
+}
@@ -0,0 +1,131 @@
+// This file contains the linear scan register allocator.
+
+package codegen
+
+import (
+	"clic/ir"
+	"sort"
+)
+
+// Allocatable x86_64 scratch registers. %rax and %rdx are left
+// out, they are used by division, return values and as temporaries
+// when both operands of an instruction are in memory.
+var allocRegs = []string{"rdi", "rsi", "rcx", "r8", "r9", "r10", "r11"}
+
+var byteRegs = map[string]string{
+	"rax": "al",
+	"rdi": "dil",
+	"rsi": "sil",
+	"rdx": "dl",
+	"rcx": "cl",
+	"r8":  "r8b",
+	"r9":  "r9b",
+	"r10": "r10b",
+	"r11": "r11b",
+}
+
+type interval struct {
+	temp  ir.Temp
+	start int
+	end   int
+}
+
+// Returns the register of every temporary, an empty string means
+// that the temporary is spilled to the frame.
+//
+// Temporaries never outlive their block, so live intervals over the
+// linear order of instructions are exact. All registers in 'allocRegs'
+// must be caller saved, temporaries that live across a call are
+// spilled.
+func allocRegisters(f *ir.Func, allocRegs []string) []string {
+	regs := make([]string, len(f.Temps))
+
+	intervals := make([]interval, len(f.Temps))
+	for i := range intervals {
+		intervals[i] = interval{temp: ir.Temp(i), start: -1, end: -1}
+	}
+	calls := []int{}
+
+	pos := 0
+	for _, block := range f.Blocks {
+		for _, instr := range block.Instrs {
+			for _, arg := range instr.Args {
+				intervals[arg].end = pos
+			}
+			if instr.Dst != ir.TempNone {
+				intervals[instr.Dst].start = pos
+				intervals[instr.Dst].end = pos
+			}
+			// The kernel clobbers registers like a call does
+			if instr.Op == ir.OpCall || instr.Op == ir.OpSyscall {
+				calls = append(calls, pos)
+			}
+			pos++
+		}
+	}
+
+	sort.SliceStable(intervals, func(i, j int) bool {
+		return intervals[i].start < intervals[j].start
+	})
+
+	free := []string{}
+	for i := len(allocRegs) - 1; i >= 0; i-- {
+		free = append(free, allocRegs[i])
+	}
+	active := []interval{}
+
+	for _, cur := range intervals {
+		if cur.start < 0 {
+			continue
+		}
+
+		// Operands are not expired at the instruction that
+		// defines cur, so a result never shares a register
+		// with an operand.
+		kept := active[:0]
+		for _, a := range active {
+			if a.end < cur.start {
+				free = append(free, regs[a.temp])
+			} else {
+				kept = append(kept, a)
+			}
+		}
+		active = kept
+
+		if crossesCall(cur, calls) {
+			continue
+		}
+
+		if len(free) > 0 {
+			regs[cur.temp] = free[len(free)-1]
+			free = free[:len(free)-1]
+			active = append(active, cur)
+			continue
+		}
+
+		// Spill whatever lives the longest
+		longest := 0
+		for i, a := range active {
+			if a.end > active[longest].end {
+				longest = i
+			}
+		}
+		if active[longest].end > cur.end {
+			victim := active[longest]
+			regs[cur.temp] = regs[victim.temp]
+			regs[victim.temp] = ""
+			active[longest] = cur
+		}
+	}
+
+	return regs
+}
+
+func crossesCall(it interval, calls []int) bool {
+	for _, call := range calls {
+		if it.start < call && call < it.end {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+// This file contains the RV64GC Linux codegen. It uses the same
+// frame layout as x86_64, with s0 as the frame pointer.
+
+package codegen
+
+import (
+	"clic/ir"
+	"fmt"
+)
+
+// Allocatable registers, all of them are caller saved. t1 and t2
+// hold operands that are in the frame, t0 holds addresses of frame
+// offsets that don't fit in an instruction.
+var rvAllocRegs = []string{"t3", "t4", "t5", "t6"}
+
+const rvArgRegsCount = 8
+
+var rvArithInstrs = map[ir.Op]string{
+	ir.OpAdd:  "add",
+	ir.OpSub:  "sub",
+	ir.OpMul:  "mul",
+	ir.OpSDiv: "div",
+	ir.OpUDiv: "divu",
+	ir.OpSRem: "rem",
+	ir.OpURem: "remu",
+}
+
+func genRVFunction(f *ir.Func, o Options) []instr {
+	e := emitter{}
+
+	regs := make([]string, len(f.Temps))
+	if o.Regalloc {
+		regs = allocRegisters(f, rvAllocRegs)
+	}
+	fr := setVarOffsets(f, regs)
+
+	e.label(f.Name)
+	e.emit("addi", "sp", "sp", "-16")
+	e.emit("sd", "ra", "8(sp)")
+	e.emit("sd", "s0", "0(sp)")
+	e.emit("mv", "s0", "sp")
+	if fr.size <= 2048 {
+		e.emit("addi", "sp", "sp", fmt.Sprintf("-%d", fr.size))
+	} else {
+		e.emit("li", "t0", fmt.Sprintf("%d", fr.size))
+		e.emit("sub", "sp", "sp", "t0")
+	}
+
+	if len(f.Params) > rvArgRegsCount {
+		panic("arguments on stack are not supported yet")
+	}
+	for i, slot := range f.Params {
+		e.rvStore(f.Slots[slot].Type, fmt.Sprintf("a%d", i), fr.slots[slot])
+	}
+
+	for id, block := range f.Blocks {
+		e.label(blockLabel(f, ir.BlockId(id)))
+		for _, instr := range block.Instrs {
+			e.rvGenInstr(f, &fr, &instr)
+		}
+	}
+
+	return e.instrs
+}
+
+// Accesses the frame at -offset from s0. Immediate offsets are 12
+// bit signed.
+func (e *emitter) rvFrame(op string, reg string, offset uint) {
+	if offset <= 2048 {
+		e.emit(op, reg, fmt.Sprintf("-%d(s0)", offset))
+		return
+	}
+
+	e.emit("li", "t0", fmt.Sprintf("%d", offset))
+	e.emit("sub", "t0", "s0", "t0")
+	e.emit(op, reg, "0(t0)")
+}
+
+func (e *emitter) rvLoad(t ir.Type, reg string, offset uint) {
+	switch t {
+	case ir.I1:
+		e.rvFrame("lbu", reg, offset)
+	case ir.I64:
+		e.rvFrame("ld", reg, offset)
+	default:
+		panic("not implemented")
+	}
+}
+
+func (e *emitter) rvStore(t ir.Type, reg string, offset uint) {
+	switch t {
+	case ir.I1:
+		e.rvFrame("sb", reg, offset)
+	case ir.I64:
+		e.rvFrame("sd", reg, offset)
+	default:
+		panic("not implemented")
+	}
+}
+
+// Returns the register holding the temporary, loading it to
+// 'scratch' if it is spilled
+func (e *emitter) rvUse(fr *frame, t ir.Temp, scratch string) string {
+	if fr.regs[t] != "" {
+		return fr.regs[t]
+	}
+	e.rvFrame("ld", scratch, fr.spills[t])
+	return scratch
+}
+
+// Returns the register to compute the temporary in. 'rvDef' has to
+// be called after the computation.
+func (fr *frame) rvDst(t ir.Temp) string {
+	if fr.regs[t] != "" {
+		return fr.regs[t]
+	}
+	return "t1"
+}
+
+func (e *emitter) rvDef(fr *frame, t ir.Temp) {
+	if fr.regs[t] == "" {
+		e.rvFrame("sd", "t1", fr.spills[t])
+	}
+}
+
+func (e *emitter) rvEpilogue() {
+	e.emit("mv", "sp", "s0")
+	e.emit("ld", "ra", "8(sp)")
+	e.emit("ld", "s0", "0(sp)")
+	e.emit("addi", "sp", "sp", "16")
+}
+
+// Allocatable registers and argument registers don't overlap, so
+// the moves can't clobber each other.
+func (e *emitter) rvMoveArgs(fr *frame, args []ir.Temp) {
+	if len(args) > rvArgRegsCount {
+		panic("arguments on stack are not supported yet")
+	}
+
+	for j, arg := range args {
+		dst := fmt.Sprintf("a%d", j)
+		if fr.regs[arg] != "" {
+			e.emit("mv", dst, fr.regs[arg])
+		} else {
+			e.rvFrame("ld", dst, fr.spills[arg])
+		}
+	}
+}
+
+func (e *emitter) rvGenInstr(f *ir.Func, fr *frame, i *ir.Instr) {
+	switch i.Op {
+	case ir.OpConst:
+		e.emit("li", fr.rvDst(i.Dst), fmt.Sprintf("%d", i.Imm))
+		e.rvDef(fr, i.Dst)
+
+	case ir.OpLoad:
+		e.rvLoad(i.Type, fr.rvDst(i.Dst), fr.slots[i.Slot])
+		e.rvDef(fr, i.Dst)
+
+	case ir.OpStore:
+		src := e.rvUse(fr, i.Args[0], "t1")
+		e.rvStore(i.Type, src, fr.slots[i.Slot])
+
+	// Bools are kept zero extended, so this is a copy
+	case ir.OpCopy, ir.OpZext:
+		src := e.rvUse(fr, i.Args[0], "t1")
+		e.emit("mv", fr.rvDst(i.Dst), src)
+		e.rvDef(fr, i.Dst)
+
+	case ir.OpAdd, ir.OpSub, ir.OpMul, ir.OpSDiv, ir.OpUDiv, ir.OpSRem, ir.OpURem:
+		lval := e.rvUse(fr, i.Args[0], "t1")
+		rval := e.rvUse(fr, i.Args[1], "t2")
+		e.emit(rvArithInstrs[i.Op], fr.rvDst(i.Dst), lval, rval)
+		e.rvDef(fr, i.Dst)
+
+	// There is only 'set less than', the rest is built from it
+	case ir.OpEq, ir.OpNe, ir.OpSLt, ir.OpSLe, ir.OpSGt, ir.OpSGe,
+		ir.OpULt, ir.OpULe, ir.OpUGt, ir.OpUGe:
+		lval := e.rvUse(fr, i.Args[0], "t1")
+		rval := e.rvUse(fr, i.Args[1], "t2")
+		dst := fr.rvDst(i.Dst)
+
+		switch i.Op {
+		case ir.OpEq, ir.OpNe:
+			e.emit("xor", dst, lval, rval)
+			if i.Op == ir.OpEq {
+				e.emit("seqz", dst, dst)
+			} else {
+				e.emit("snez", dst, dst)
+			}
+
+		case ir.OpSLt, ir.OpULt, ir.OpSGe, ir.OpUGe:
+			e.emit(rvSlt(i.Op), dst, lval, rval)
+
+		case ir.OpSGt, ir.OpUGt, ir.OpSLe, ir.OpULe:
+			e.emit(rvSlt(i.Op), dst, rval, lval)
+		}
+
+		switch i.Op {
+		case ir.OpSGe, ir.OpUGe, ir.OpSLe, ir.OpULe:
+			e.emit("xori", dst, dst, "1")
+		}
+		e.rvDef(fr, i.Dst)
+
+	case ir.OpCall:
+		e.rvMoveArgs(fr, i.Args)
+		e.emit("call", i.Fun)
+
+		if i.Dst != ir.TempNone {
+			// Only the low byte is defined for bools
+			if i.Type == ir.I1 {
+				e.emit("andi", "a0", "a0", "0xff")
+			}
+			e.emit("mv", fr.rvDst(i.Dst), "a0")
+			e.rvDef(fr, i.Dst)
+		}
+
+	// The number goes in a7, the kernel preserves everything
+	// but a0
+	case ir.OpSyscall:
+		e.rvMoveArgs(fr, i.Args[1:])
+		num := e.rvUse(fr, i.Args[0], "a7")
+		if num != "a7" {
+			e.emit("mv", "a7", num)
+		}
+		e.emit("ecall")
+		e.emit("mv", fr.rvDst(i.Dst), "a0")
+		e.rvDef(fr, i.Dst)
+
+	case ir.OpJump:
+		e.emit("j", blockLabel(f, i.Targets[0]))
+
+	case ir.OpBranch:
+		cond := e.rvUse(fr, i.Args[0], "t1")
+		e.emit("bnez", cond, blockLabel(f, i.Targets[0]))
+		e.emit("j", blockLabel(f, i.Targets[1]))
+
+	case ir.OpRet:
+		if len(i.Args) != 0 {
+			src := e.rvUse(fr, i.Args[0], "t1")
+			e.emit("mv", "a0", src)
+		}
+		e.rvEpilogue()
+		e.emit("ret")
+
+	// ra is restored, the callee returns straight to our caller
+	case ir.OpTailCall:
+		e.rvMoveArgs(fr, i.Args)
+		e.rvEpilogue()
+		e.emit("tail", i.Fun)
+
+	default:
+		panic("not implemented")
+	}
+}
+
+func rvSlt(op ir.Op) string {
+	switch op {
+	case ir.OpULt, ir.OpUGe, ir.OpUGt, ir.OpULe:
+		return "sltu"
+	default:
+		return "slt"
+	}
+}
@@ -0,0 +1,251 @@
+// This file contains the writer of ELF64 relocatable object files
+// for x86_64.
+
+package elf
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type Section uint16
+
+// Sections symbols can be defined in
+const (
+	SectionUndef Section = iota
+	SectionText
+	SectionData
+	SectionRodata
+)
+
+type Symbol struct {
+	Name    string
+	Section Section // SectionUndef for symbols of other objects
+	Value   uint64  // Offset in the section
+	Size    uint64
+	Func    bool
+	Global  bool
+}
+
+// Relocation types of x86_64
+const (
+	RelocPC32  uint32 = 2
+	RelocPLT32 uint32 = 4
+)
+
+// Relocation in '.text'
+type Reloc struct {
+	Offset uint64
+	Symbol string
+	Type   uint32
+	Addend int64
+}
+
+type Object struct {
+	Text   []byte
+	Data   []byte
+	Rodata []byte
+
+	Symbols []Symbol
+	Relocs  []Reloc
+}
+
+const (
+	headerSize  = 64
+	sectionSize = 64
+	symbolSize  = 24
+	relocSize   = 24
+)
+
+// Section header types and flags
+const (
+	shtProgbits = 1
+	shtSymtab   = 2
+	shtStrtab   = 3
+	shtRela     = 4
+
+	shfWrite     = 0x1
+	shfAlloc     = 0x2
+	shfExecinstr = 0x4
+	shfInfoLink  = 0x40
+)
+
+// Symbol bindings and types
+const (
+	stbLocal  = 0
+	stbGlobal = 1
+
+	sttNotype = 0
+	sttFunc   = 2
+)
+
+// Indices of the section headers. The ones symbols are defined in
+// come first, so they match 'Section'.
+const (
+	shNull = iota
+	shText
+	shData
+	shRodata
+	shRelaText
+	shSymtab
+	shStrtab
+	shShstrtab
+	shNoteStack
+	shCount
+)
+
+type strtab struct {
+	data []byte
+}
+
+// The first byte is the empty name
+func newStrtab() strtab {
+	return strtab{data: []byte{0}}
+}
+
+func (s *strtab) add(name string) uint32 {
+	if name == "" {
+		return 0
+	}
+	offset := uint32(len(s.data))
+	s.data = append(s.data, name...)
+	s.data = append(s.data, 0)
+	return offset
+}
+
+type sectionHeader struct {
+	name      uint32
+	typ       uint32
+	flags     uint64
+	offset    uint64
+	size      uint64
+	link      uint32
+	info      uint32
+	addralign uint64
+	entsize   uint64
+}
+
+// Lays out the file as: header, section contents, section headers
+func (o *Object) Bytes() []byte {
+	le := binary.LittleEndian
+
+	// Local symbols have to come before the global ones
+	symbols := []Symbol{}
+	for _, sym := range o.Symbols {
+		if !sym.Global {
+			symbols = append(symbols, sym)
+		}
+	}
+	firstGlobal := len(symbols) + 1
+	for _, sym := range o.Symbols {
+		if sym.Global {
+			symbols = append(symbols, sym)
+		}
+	}
+
+	strs := newStrtab()
+	indices := map[string]int{}
+	symtab := make([]byte, symbolSize)
+	for i, sym := range symbols {
+		indices[sym.Name] = i + 1
+
+		bind, typ := byte(stbLocal), byte(sttNotype)
+		if sym.Global {
+			bind = stbGlobal
+		}
+		if sym.Func {
+			typ = sttFunc
+		}
+
+		entry := make([]byte, symbolSize)
+		le.PutUint32(entry[0:], strs.add(sym.Name))
+		entry[4] = bind<<4 | typ
+		le.PutUint16(entry[6:], uint16(sym.Section))
+		le.PutUint64(entry[8:], sym.Value)
+		le.PutUint64(entry[16:], sym.Size)
+		symtab = append(symtab, entry...)
+	}
+
+	rela := []byte{}
+	for _, r := range o.Relocs {
+		entry := make([]byte, relocSize)
+		le.PutUint64(entry[0:], r.Offset)
+		index, ok := indices[r.Symbol]
+		if !ok {
+			panic(fmt.Sprintf("relocation against unknown symbol '%s'", r.Symbol))
+		}
+		le.PutUint64(entry[8:], uint64(index)<<32|uint64(r.Type))
+		le.PutUint64(entry[16:], uint64(r.Addend))
+		rela = append(rela, entry...)
+	}
+
+	shstrs := newStrtab()
+	headers := make([]sectionHeader, shCount)
+	headers[shText] = sectionHeader{name: shstrs.add(".text"), typ: shtProgbits,
+		flags: shfAlloc | shfExecinstr, addralign: 16}
+	headers[shData] = sectionHeader{name: shstrs.add(".data"), typ: shtProgbits,
+		flags: shfWrite | shfAlloc, addralign: 8}
+	headers[shRodata] = sectionHeader{name: shstrs.add(".rodata"), typ: shtProgbits,
+		flags: shfAlloc, addralign: 8}
+	headers[shRelaText] = sectionHeader{name: shstrs.add(".rela.text"), typ: shtRela,
+		flags: shfInfoLink, link: shSymtab, info: shText, addralign: 8, entsize: relocSize}
+	headers[shSymtab] = sectionHeader{name: shstrs.add(".symtab"), typ: shtSymtab,
+		link: shStrtab, info: uint32(firstGlobal), addralign: 8, entsize: symbolSize}
+	headers[shStrtab] = sectionHeader{name: shstrs.add(".strtab"), typ: shtStrtab, addralign: 1}
+	headers[shShstrtab] = sectionHeader{name: shstrs.add(".shstrtab"), typ: shtStrtab, addralign: 1}
+
+	// Marks the stack as not executable for the linker
+	headers[shNoteStack] = sectionHeader{name: shstrs.add(".note.GNU-stack"), typ: shtProgbits, addralign: 1}
+
+	contents := [shCount][]byte{
+		shText:     o.Text,
+		shData:     o.Data,
+		shRodata:   o.Rodata,
+		shRelaText: rela,
+		shSymtab:   symtab,
+		shStrtab:   strs.data,
+		shShstrtab: shstrs.data,
+	}
+
+	out := make([]byte, headerSize)
+	for i := 1; i < shCount; i++ {
+		align := int(headers[i].addralign)
+		for len(out)%align != 0 {
+			out = append(out, 0)
+		}
+		headers[i].offset = uint64(len(out))
+		headers[i].size = uint64(len(contents[i]))
+		out = append(out, contents[i]...)
+	}
+
+	for len(out)%8 != 0 {
+		out = append(out, 0)
+	}
+	shoff := len(out)
+	for _, h := range headers {
+		entry := make([]byte, sectionSize)
+		le.PutUint32(entry[0:], h.name)
+		le.PutUint32(entry[4:], h.typ)
+		le.PutUint64(entry[8:], h.flags)
+		le.PutUint64(entry[24:], h.offset)
+		le.PutUint64(entry[32:], h.size)
+		le.PutUint32(entry[40:], h.link)
+		le.PutUint32(entry[44:], h.info)
+		le.PutUint64(entry[48:], h.addralign)
+		le.PutUint64(entry[56:], h.entsize)
+		out = append(out, entry...)
+	}
+
+	// Class 64, little endian, current version, System V ABI
+	copy(out, []byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0})
+	le.PutUint16(out[16:], 1)  // ET_REL
+	le.PutUint16(out[18:], 62) // EM_X86_64
+	le.PutUint32(out[20:], 1)  // EV_CURRENT
+	le.PutUint64(out[40:], uint64(shoff))
+	le.PutUint16(out[52:], headerSize)
+	le.PutUint16(out[58:], sectionSize)
+	le.PutUint16(out[60:], shCount)
+	le.PutUint16(out[62:], shShstrtab)
+
+	return out
+}
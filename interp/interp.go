@@ -0,0 +1,350 @@
+// This file contains the tree-walking interpreter. It evaluates the
+// checked AST directly and is meant to be the reference for the
+// semantics of CLI, so it favors being obvious over being fast.
+
+package interp
+
+import (
+	"clic/ast"
+	"clic/symbol"
+	"clic/types"
+	"clic/vm"
+	"fmt"
+	"io"
+)
+
+// Built-in implementation of an 'exfun'. Every value is a uint64,
+// signed integers are two's complement and bools are 0 or 1.
+type exfun func(in *Interp, args []uint64) uint64
+
+var builtins = map[string]exfun{
+	"print_s64": func(in *Interp, args []uint64) uint64 {
+		fmt.Fprintln(in.out, int64(args[0]))
+		return 0
+	},
+	"print_u64": func(in *Interp, args []uint64) uint64 {
+		fmt.Fprintln(in.out, args[0])
+		return 0
+	},
+	"print_bool": func(in *Interp, args []uint64) uint64 {
+		fmt.Fprintln(in.out, args[0] != 0)
+		return 0
+	},
+}
+
+// Calls nest on the Go stack, which is fatal to overflow. The limit
+// is the one of the VM, so both run the same programs.
+const maxDepth = vm.MaxFrames
+
+type Interp struct {
+	t   *symbol.Table
+	out io.Writer
+
+	funcs map[symbol.Id]*ast.Node
+	depth int
+}
+
+// Errors at run time unwind the Go stack to 'Call' as panics
+type runtimeError struct {
+	msg string
+}
+
+func New(roots []*ast.Node, t *symbol.Table, out io.Writer) *Interp {
+	in := &Interp{
+		t:     t,
+		out:   out,
+		funcs: make(map[symbol.Id]*ast.Node),
+	}
+
+	defined := map[string]*ast.Node{}
+	for _, node := range roots {
+		if node.Tag == ast.NodeFunDef {
+			in.funcs[node.Id] = node
+			defined[in.t.Get(node.Id).Name] = node
+		}
+	}
+
+	// Declarations inside of functions have their own symbols
+	for _, root := range roots {
+		ast.Walk(root, func(n *ast.Node) {
+			if n.Tag != ast.NodeFunDecl {
+				return
+			}
+			if fn, ok := defined[in.t.Get(n.Id).Name]; ok {
+				in.funcs[n.Id] = fn
+			}
+		})
+	}
+
+	return in
+}
+
+// Runs a function to completion. The result is 0 for functions
+// returning void.
+func (in *Interp) Call(name string, args ...uint64) (res uint64, err error) {
+	for id, fn := range in.funcs {
+		if in.t.Get(id).Name != name {
+			continue
+		}
+		if len(args) != len(fn.Fun.Params) {
+			return 0, fmt.Errorf("function '%s' expects %d arguments, got %d", name, len(fn.Fun.Params), len(args))
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				e, ok := r.(runtimeError)
+				if !ok {
+					panic(r)
+				}
+				err = fmt.Errorf("%s", e.msg)
+			}
+		}()
+		return in.call(fn, args), nil
+	}
+
+	return 0, fmt.Errorf("function '%s' is not defined", name)
+}
+
+func fail(format string, args ...any) {
+	panic(runtimeError{msg: fmt.Sprintf(format, args...)})
+}
+
+// What running statements ended with
+type outcome struct {
+	returned bool
+	value    uint64
+
+	// Call in tail position, it runs after the frame of the
+	// caller is gone
+	tail *ast.Node
+	args []uint64
+}
+
+// Locals missing from the map read as 0
+type frame struct {
+	locals map[symbol.Id]uint64
+}
+
+func (in *Interp) call(fn *ast.Node, args []uint64) uint64 {
+	in.depth++
+	if in.depth > maxDepth {
+		fail("stack overflow in '%s'", in.t.Get(fn.Id).Name)
+	}
+	defer func() { in.depth-- }()
+
+	for {
+		fr := frame{locals: make(map[symbol.Id]uint64)}
+		for i, param := range fn.Fun.Params {
+			fr.locals[param] = args[i]
+		}
+
+		o := in.execStmts(&fr, fn.Fun.Stmts)
+		if o.tail == nil {
+			return o.value
+		}
+		fn, args = o.tail, o.args
+	}
+}
+
+func (in *Interp) execStmts(fr *frame, stmts []*ast.Node) outcome {
+	for _, stmt := range stmts {
+		o := in.exec(fr, stmt)
+		if o.returned {
+			return o
+		}
+	}
+	return outcome{}
+}
+
+func (in *Interp) exec(fr *frame, n *ast.Node) outcome {
+	switch n.Tag {
+	// Locals start zeroed, see 'frame'. Calls find the functions
+	// declared inside of functions in 'New'.
+	case ast.NodeEmpty, ast.NodeLVarDecl, ast.NodeTypedef, ast.NodeFunEx, ast.NodeFunDecl:
+
+	case ast.NodeScope:
+		return in.execStmts(fr, n.Scope.Stmts)
+
+	// Only the calls written with 'tailcall', the others are
+	// tail calls only as an optimization
+	case ast.NodeReturn:
+		val := n.Return.Val
+		if val.Tag == ast.NodeFunCall && val.Fun.Tail {
+			if fn, ok := in.funcs[val.Id]; ok {
+				return outcome{returned: true, tail: fn, args: in.evalArgs(fr, val)}
+			}
+		}
+
+		o := outcome{returned: true}
+		if val.Tag != ast.NodeEmpty {
+			o.value = in.eval(fr, val)
+		}
+		return o
+
+	case ast.NodeIf:
+		if in.eval(fr, n.If.Exp) != 0 {
+			return in.execStmts(fr, n.If.IfStmts)
+		}
+		return in.execStmts(fr, n.If.ElseStmts)
+
+	case ast.NodeWhile:
+		return in.loop(fr, n.While.Exp, n.While.Stmts, nil)
+
+	case ast.NodeFor:
+		in.exec(fr, n.For.Init)
+		return in.loop(fr, n.For.Cond, n.For.Stmts, n.For.Adv)
+
+	default:
+		in.eval(fr, n)
+	}
+
+	return outcome{}
+}
+
+func (in *Interp) loop(fr *frame, cond *ast.Node, stmts []*ast.Node, adv *ast.Node) outcome {
+	for in.eval(fr, cond) != 0 {
+		o := in.execStmts(fr, stmts)
+		if o.returned {
+			return o
+		}
+		if adv != nil {
+			in.exec(fr, adv)
+		}
+	}
+	return outcome{}
+}
+
+// Arguments are evaluated left to right
+func (in *Interp) evalArgs(fr *frame, n *ast.Node) []uint64 {
+	args := []uint64{}
+	for _, arg := range n.Fun.Args {
+		args = append(args, in.eval(fr, arg))
+	}
+	return args
+}
+
+func boolValue(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (in *Interp) eval(fr *frame, n *ast.Node) uint64 {
+	switch n.Tag {
+	case ast.NodeInt:
+		if n.Int.Signed {
+			return uint64(n.Int.SValue)
+		}
+		return n.Int.UValue
+
+	case ast.NodeBool:
+		return boolValue(n.Bool.Value)
+
+	case ast.NodeLVar:
+		return fr.locals[n.Id]
+
+	case ast.NodeFunCall:
+		args := in.evalArgs(fr, n)
+		if fn, ok := in.funcs[n.Id]; ok {
+			return in.call(fn, args)
+		}
+
+		name := in.t.Get(n.Id).Name
+		ext, ok := builtins[name]
+		if !ok {
+			fail("exfun '%s' has no built-in implementation", name)
+		}
+		return ext(in, args)
+
+	// System calls need real memory and the numbers depend on
+	// the target
+	case ast.NodeSyscall:
+		in.evalArgs(fr, n)
+		fail("%d:%d: syscall is not supported by the interpreter", n.Line, n.Column)
+		return 0
+
+	// Integer types share their representation and bools are
+	// already 0 or 1, so only conversions to bool do something.
+	case ast.NodeCast:
+		val := in.eval(fr, n.Cast.What)
+		if n.Cast.To.Underlying() == types.GetBuiltin(types.Bool) {
+			return boolValue(val != 0)
+		}
+		return val
+
+	case ast.NodeBinOp:
+		return in.evalBinOp(fr, n)
+
+	default:
+		panic("not implemented")
+	}
+}
+
+func (in *Interp) evalBinOp(fr *frame, n *ast.Node) uint64 {
+	if n.BinOp.Tag == ast.BinOpAssign {
+		val := in.eval(fr, n.BinOp.Rval)
+		fr.locals[n.BinOp.Lval.Id] = val
+		return val
+	}
+
+	// Operands are evaluated left to right
+	l := in.eval(fr, n.BinOp.Lval)
+	r := in.eval(fr, n.BinOp.Rval)
+	unsigned := n.BinOp.Lval.GetTypeDeep(in.t) == types.GetBuiltin(types.U64)
+
+	switch n.BinOp.Tag {
+	case ast.BinOpArith:
+		switch n.BinOp.ArithTag {
+		case ast.BinOpSum:
+			return l + r
+		case ast.BinOpSub:
+			return l - r
+		case ast.BinOpMult:
+			return l * r
+		}
+
+		if r == 0 {
+			fail("%d:%d: division by zero", n.Line, n.Column)
+		}
+		switch {
+		case n.BinOp.ArithTag == ast.BinOpDiv && unsigned:
+			return l / r
+		case n.BinOp.ArithTag == ast.BinOpDiv:
+			return uint64(int64(l) / int64(r))
+		case unsigned:
+			return l % r
+		default:
+			return uint64(int64(l) % int64(r))
+		}
+
+	case ast.BinOpComp:
+		switch n.BinOp.CompTag {
+		case ast.BinOpEq:
+			return boolValue(l == r)
+		case ast.BinOpNeq:
+			return boolValue(l != r)
+		}
+
+		less, equal := int64(l) < int64(r), l == r
+		if unsigned {
+			less = l < r
+		}
+
+		switch n.BinOp.CompTag {
+		case ast.BinOpLessEq:
+			return boolValue(less || equal)
+		case ast.BinOpLess:
+			return boolValue(less)
+		case ast.BinOpGreatEq:
+			return boolValue(!less)
+		case ast.BinOpGreat:
+			return boolValue(!less && !equal)
+		default:
+			panic("not implemented")
+		}
+
+	default:
+		panic("not implemented")
+	}
+}
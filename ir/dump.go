@@ -0,0 +1,178 @@
+// This file contains the textual dump of the IR.
+
+package ir
+
+import (
+	"fmt"
+)
+
+func (t Type) Stringify() string {
+	switch t {
+	case Void:
+		return "void"
+	case I1:
+		return "i1"
+	case I64:
+		return "i64"
+	default:
+		panic("not implemented")
+	}
+}
+
+func (op Op) Stringify() string {
+	switch op {
+	case OpConst:
+		return "const"
+	case OpLoad:
+		return "load"
+	case OpStore:
+		return "store"
+	case OpCopy:
+		return "copy"
+	case OpAdd:
+		return "add"
+	case OpSub:
+		return "sub"
+	case OpMul:
+		return "mul"
+	case OpSDiv:
+		return "sdiv"
+	case OpUDiv:
+		return "udiv"
+	case OpSRem:
+		return "srem"
+	case OpURem:
+		return "urem"
+	case OpEq:
+		return "eq"
+	case OpNe:
+		return "ne"
+	case OpSLt:
+		return "slt"
+	case OpSLe:
+		return "sle"
+	case OpSGt:
+		return "sgt"
+	case OpSGe:
+		return "sge"
+	case OpULt:
+		return "ult"
+	case OpULe:
+		return "ule"
+	case OpUGt:
+		return "ugt"
+	case OpUGe:
+		return "uge"
+	case OpZext:
+		return "zext"
+	case OpCall:
+		return "call"
+	case OpSyscall:
+		return "syscall"
+	case OpJump:
+		return "jmp"
+	case OpBranch:
+		return "br"
+	case OpRet:
+		return "ret"
+	case OpTailCall:
+		return "tailcall"
+	default:
+		panic("not implemented")
+	}
+}
+
+func (p *Program) Stringify() string {
+	s := ""
+
+	for _, ext := range p.Externs {
+		s += fmt.Sprintf("extern %s(%s) %s\n",
+			ext.Name, stringifyTypes(ext.Params), ext.Ret.Stringify())
+	}
+
+	for _, f := range p.Funcs {
+		if s != "" {
+			s += "\n"
+		}
+		s += f.Stringify()
+	}
+
+	return s
+}
+
+func (f *Func) Stringify() string {
+	params := []Type{}
+	for _, slot := range f.Params {
+		params = append(params, f.Slots[slot].Type)
+	}
+
+	s := fmt.Sprintf("func %s(%s) %s {\n",
+		f.Name, stringifyTypes(params), f.Ret.Stringify())
+	if f.Export {
+		s = "export " + s
+	}
+
+	for i, slot := range f.Slots {
+		s += fmt.Sprintf("\tslot s%d %s: %s\n", i, slot.Name, slot.Type.Stringify())
+	}
+
+	for i, block := range f.Blocks {
+		s += fmt.Sprintf("b%d:\n", i)
+		for _, instr := range block.Instrs {
+			s += "\t" + instr.Stringify() + "\n"
+		}
+	}
+
+	s += "}\n"
+	return s
+}
+
+func (i *Instr) Stringify() string {
+	s := ""
+	if i.Dst != TempNone {
+		s += fmt.Sprintf("t%d = ", i.Dst)
+	}
+
+	s += i.Op.Stringify()
+	if i.Type != typeError && i.Op != OpJump && i.Op != OpBranch && i.Op != OpRet {
+		s += "." + i.Type.Stringify()
+	}
+
+	operands := []string{}
+	switch i.Op {
+	case OpConst:
+		operands = append(operands, fmt.Sprintf("%d", i.Imm))
+	case OpLoad, OpStore:
+		operands = append(operands, fmt.Sprintf("s%d", i.Slot))
+	case OpCall, OpTailCall:
+		operands = append(operands, i.Fun)
+	}
+	for _, arg := range i.Args {
+		operands = append(operands, fmt.Sprintf("t%d", arg))
+	}
+	for _, target := range i.Targets {
+		operands = append(operands, fmt.Sprintf("b%d", target))
+	}
+
+	for j, operand := range operands {
+		if j == 0 {
+			s += " "
+		} else {
+			s += ", "
+		}
+		s += operand
+	}
+
+	return s
+}
+
+func stringifyTypes(ts []Type) string {
+	s := ""
+	for i, t := range ts {
+		if i > 0 {
+			s += ", "
+		}
+		s += t.Stringify()
+	}
+	return s
+}
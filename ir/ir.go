@@ -0,0 +1,214 @@
+// This file contains the intermediate representation definition.
+//
+// The IR is a three-address code. Values live in temporaries that
+// are assigned exactly once and never outlive the basic block they
+// are defined in. Local variables live in stack slots and are
+// accessed with explicit loads and stores.
+
+package ir
+
+type Type uint
+
+const (
+	typeError Type = iota
+	Void
+	I1 // bool, one byte in memory
+	I64
+)
+
+type Temp int
+type Slot int
+type BlockId int
+
+const TempNone Temp = -1
+
+type Op uint
+
+const (
+	opError Op = iota
+
+	OpConst // Dst = Imm
+	OpLoad  // Dst = Slot
+	OpStore // Slot = Args[0]
+	OpCopy  // Dst = Args[0]
+
+	// Dst = Args[0] op Args[1]
+	OpAdd
+	OpSub
+	OpMul
+	OpSDiv
+	OpUDiv
+	OpSRem
+	OpURem
+
+	// Dst (I1) = Args[0] op Args[1]
+	OpEq
+	OpNe
+	OpSLt
+	OpSLe
+	OpSGt
+	OpSGe
+	OpULt
+	OpULe
+	OpUGt
+	OpUGe
+
+	OpZext // Dst (I64) = Args[0] (I1)
+
+	OpCall    // Dst = Fun(Args...), Dst is TempNone for void
+	OpSyscall // Dst (I64) = system call Args[0] with Args[1:]
+
+	// Terminators, every block ends with exactly one
+	OpJump   // goto Targets[0]
+	OpBranch // if Args[0] goto Targets[0] else goto Targets[1]
+	OpRet    // return Args[0], no Args for void
+
+	// return Fun(Args...), reusing the frame of the caller
+	OpTailCall
+)
+
+type Instr struct {
+	Op   Op
+	Type Type // Type of Dst, or of the stored value
+	Dst  Temp
+	Args []Temp
+
+	Imm     int64 // u64 constants are stored as their bits
+	Slot    Slot
+	Fun     string
+	Targets []BlockId
+}
+
+type Block struct {
+	Instrs []Instr
+}
+
+type SlotInfo struct {
+	Name string
+	Type Type
+}
+
+type InlineHint uint
+
+const (
+	InlineAuto InlineHint = iota // Decided by size
+	InlineAlways
+	InlineNever
+)
+
+type Func struct {
+	Name   string
+	Params []Slot // Arguments are stored to these slots on entry
+	Ret    Type
+	Inline InlineHint
+	Export bool
+
+	Slots  []SlotInfo
+	Temps  []Type
+	Blocks []*Block // Blocks[0] is the entry
+}
+
+type Extern struct {
+	Name   string
+	Params []Type
+	Ret    Type
+}
+
+type Program struct {
+	Externs []Extern
+	Funcs   []*Func
+}
+
+func (t Type) Size() uint {
+	switch t {
+	case Void:
+		return 0
+	case I1:
+		return 1
+	case I64:
+		return 8
+	default:
+		panic("not implemented")
+	}
+}
+
+// Calls to void functions have no result either, their Dst is
+// TempNone.
+func (op Op) HasDst() bool {
+	return op != OpStore && !op.IsTerminator()
+}
+
+func (op Op) IsTerminator() bool {
+	return op == OpJump || op == OpBranch || op == OpRet || op == OpTailCall
+}
+
+func (f *Func) NewTemp(t Type) Temp {
+	f.Temps = append(f.Temps, t)
+	return Temp(len(f.Temps) - 1)
+}
+
+func (f *Func) NewSlot(name string, t Type) Slot {
+	f.Slots = append(f.Slots, SlotInfo{Name: name, Type: t})
+	return Slot(len(f.Slots) - 1)
+}
+
+func (f *Func) NewBlock() BlockId {
+	f.Blocks = append(f.Blocks, &Block{})
+	return BlockId(len(f.Blocks) - 1)
+}
+
+func (b *Block) Terminator() *Instr {
+	if len(b.Instrs) == 0 {
+		return nil
+	}
+	last := &b.Instrs[len(b.Instrs)-1]
+	if !last.Op.IsTerminator() {
+		return nil
+	}
+	return last
+}
+
+// Removes blocks that can't be reached from the entry and
+// renumbers the rest, keeping their order.
+func (f *Func) RemoveUnreachable() {
+	reached := make([]bool, len(f.Blocks))
+	stack := []BlockId{0}
+	reached[0] = true
+
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		term := f.Blocks[id].Terminator()
+		if term == nil {
+			continue
+		}
+		for _, target := range term.Targets {
+			if !reached[target] {
+				reached[target] = true
+				stack = append(stack, target)
+			}
+		}
+	}
+
+	remap := make([]BlockId, len(f.Blocks))
+	blocks := []*Block{}
+	for i, block := range f.Blocks {
+		if reached[i] {
+			remap[i] = BlockId(len(blocks))
+			blocks = append(blocks, block)
+		}
+	}
+
+	for _, block := range blocks {
+		term := block.Terminator()
+		if term == nil {
+			continue
+		}
+		for i, target := range term.Targets {
+			term.Targets[i] = remap[target]
+		}
+	}
+
+	f.Blocks = blocks
+}
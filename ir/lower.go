@@ -0,0 +1,398 @@
+// This file contains the lowering from the checked AST to the IR.
+
+package ir
+
+import (
+	"clic/ast"
+	"clic/symbol"
+	"clic/types"
+)
+
+type lowerer struct {
+	t *symbol.Table
+
+	// Every call in tail position becomes a tail call, not only
+	// the ones written with 'tailcall'
+	tailCalls bool
+
+	fun   *Func
+	block BlockId
+	slots map[symbol.Id]Slot
+}
+
+func Lower(roots []*ast.Node, t *symbol.Table, tailCalls bool) *Program {
+	p := &Program{}
+
+	// External functions can also be declared inside of functions,
+	// every declaration of a name is the same function
+	declared := map[string]bool{}
+	for _, root := range roots {
+		ast.Walk(root, func(n *ast.Node) {
+			if n.Tag != ast.NodeFunEx {
+				return
+			}
+			sym := t.Get(n.Id)
+			if declared[sym.Name] {
+				return
+			}
+			declared[sym.Name] = true
+
+			ext := Extern{Name: sym.Name, Ret: lowerType(sym.Type)}
+			for _, param := range sym.Fun.Params {
+				ext.Params = append(ext.Params, lowerType(param.Type))
+			}
+			p.Externs = append(p.Externs, ext)
+		})
+	}
+
+	for _, node := range roots {
+		switch node.Tag {
+		case ast.NodeFunDef:
+			l := lowerer{t: t, tailCalls: tailCalls, slots: make(map[symbol.Id]Slot)}
+			p.Funcs = append(p.Funcs, l.lowerFunction(node))
+		}
+	}
+
+	return p
+}
+
+func lowerType(id types.Id) Type {
+	switch types.Get(id.Underlying()).Tag {
+	case types.Void:
+		return Void
+	case types.Bool:
+		return I1
+	case types.S64, types.U64:
+		return I64
+	default:
+		panic("not implemented")
+	}
+}
+
+func isUnsigned(id types.Id) bool {
+	return id.Underlying() == types.GetBuiltin(types.U64)
+}
+
+func (l *lowerer) lowerFunction(n *ast.Node) *Func {
+	sym := l.t.Get(n.Id)
+
+	l.fun = &Func{
+		Name:   sym.Name,
+		Ret:    lowerType(sym.Type),
+		Export: n.Fun.Export,
+	}
+
+	if n.Fun.Inline {
+		l.fun.Inline = InlineAlways
+	} else if n.Fun.NoInline {
+		l.fun.Inline = InlineNever
+	}
+	l.block = l.fun.NewBlock()
+
+	for _, param := range n.Fun.Params {
+		l.fun.Params = append(l.fun.Params, l.slotFor(param))
+	}
+
+	for _, stmt := range n.Fun.Stmts {
+		l.lowerNode(stmt)
+	}
+
+	// Only reachable in void functions, 'checker' makes sure
+	// the others return on every path.
+	if l.fun.Blocks[l.block].Terminator() == nil {
+		l.emit(Instr{Op: OpRet})
+	}
+
+	l.fun.RemoveUnreachable()
+	return l.fun
+}
+
+func (l *lowerer) slotFor(id symbol.Id) Slot {
+	slot, ok := l.slots[id]
+	if !ok {
+		sym := l.t.Get(id)
+		slot = l.fun.NewSlot(sym.Name, lowerType(sym.Type))
+		l.slots[id] = slot
+	}
+	return slot
+}
+
+// Code after a terminator goes to a new block without
+// predecessors, it is removed at the end.
+func (l *lowerer) emit(i Instr) {
+	if l.fun.Blocks[l.block].Terminator() != nil {
+		l.block = l.fun.NewBlock()
+	}
+	if !i.Op.HasDst() {
+		i.Dst = TempNone
+	}
+	l.fun.Blocks[l.block].Instrs = append(l.fun.Blocks[l.block].Instrs, i)
+}
+
+func (l *lowerer) emitValue(i Instr) Temp {
+	i.Dst = l.fun.NewTemp(i.Type)
+	l.emit(i)
+	return i.Dst
+}
+
+// Lowers the arguments and returns the call, without emitting it
+func (l *lowerer) lowerCall(n *ast.Node, op Op) Instr {
+	sym := l.t.Get(n.Id)
+
+	args := []Temp{}
+	for _, arg := range n.Fun.Args {
+		args = append(args, l.lowerNode(arg))
+	}
+
+	return Instr{
+		Op:   op,
+		Type: lowerType(sym.Type),
+		Dst:  TempNone,
+		Args: args,
+		Fun:  sym.Name,
+	}
+}
+
+func (l *lowerer) jump(to BlockId) {
+	l.emit(Instr{Op: OpJump, Targets: []BlockId{to}})
+}
+
+func (l *lowerer) branch(cond Temp, then BlockId, else_ BlockId) {
+	l.emit(Instr{
+		Op:      OpBranch,
+		Args:    []Temp{cond},
+		Targets: []BlockId{then, else_},
+	})
+}
+
+func (l *lowerer) lowerStmts(stmts []*ast.Node) {
+	for _, stmt := range stmts {
+		l.lowerNode(stmt)
+	}
+}
+
+// Returns TempNone for nodes without a value
+func (l *lowerer) lowerNode(n *ast.Node) Temp {
+	switch n.Tag {
+	case ast.NodeScope:
+		l.lowerStmts(n.Scope.Stmts)
+
+	case ast.NodeInt:
+		imm := n.Int.SValue
+		if !n.Int.Signed {
+			imm = int64(n.Int.UValue)
+		}
+		return l.emitValue(Instr{Op: OpConst, Type: I64, Imm: imm})
+
+	case ast.NodeBool:
+		imm := int64(0)
+		if n.Bool.Value {
+			imm = 1
+		}
+		return l.emitValue(Instr{Op: OpConst, Type: I1, Imm: imm})
+
+	case ast.NodeLVar:
+		slot := l.slotFor(n.Id)
+		return l.emitValue(Instr{
+			Op:   OpLoad,
+			Type: l.fun.Slots[slot].Type,
+			Slot: slot,
+		})
+
+	case ast.NodeBinOp:
+		return l.lowerBinOp(n)
+
+	case ast.NodeFunCall:
+		i := l.lowerCall(n, OpCall)
+		if i.Type == Void {
+			l.emit(i)
+			return TempNone
+		}
+		return l.emitValue(i)
+
+	case ast.NodeCast:
+		return l.lowerCast(n)
+
+	case ast.NodeSyscall:
+		args := []Temp{}
+		for _, arg := range n.Fun.Args {
+			args = append(args, l.lowerNode(arg))
+		}
+		return l.emitValue(Instr{Op: OpSyscall, Type: I64, Args: args})
+
+	case ast.NodeReturn:
+		val := n.Return.Val
+		if val.Tag == ast.NodeFunCall && (val.Fun.Tail || l.tailCalls) {
+			l.emit(l.lowerCall(val, OpTailCall))
+			break
+		}
+
+		ret := l.lowerNode(val)
+		if ret == TempNone {
+			l.emit(Instr{Op: OpRet})
+		} else {
+			l.emit(Instr{Op: OpRet, Args: []Temp{ret}})
+		}
+
+	case ast.NodeIf:
+		then := l.fun.NewBlock()
+		end := l.fun.NewBlock()
+		else_ := end
+		if len(n.If.ElseStmts) != 0 {
+			else_ = l.fun.NewBlock()
+		}
+
+		l.branch(l.lowerNode(n.If.Exp), then, else_)
+
+		l.block = then
+		l.lowerStmts(n.If.IfStmts)
+		l.jump(end)
+
+		if else_ != end {
+			l.block = else_
+			l.lowerStmts(n.If.ElseStmts)
+			l.jump(end)
+		}
+
+		l.block = end
+
+	case ast.NodeWhile:
+		l.lowerLoop(n.While.Exp, n.While.Stmts, nil)
+
+	case ast.NodeFor:
+		l.lowerNode(n.For.Init)
+		l.lowerLoop(n.For.Cond, n.For.Stmts, n.For.Adv)
+
+	// Do nothing
+	case ast.NodeLVarDecl:
+	case ast.NodeFunEx:
+	case ast.NodeFunDecl:
+	case ast.NodeTypedef:
+	case ast.NodeEmpty:
+
+	default:
+		panic("not implemented")
+	}
+
+	return TempNone
+}
+
+func (l *lowerer) lowerLoop(cond *ast.Node, stmts []*ast.Node, adv *ast.Node) {
+	start := l.fun.NewBlock()
+	body := l.fun.NewBlock()
+	end := l.fun.NewBlock()
+
+	l.jump(start)
+
+	l.block = start
+	l.branch(l.lowerNode(cond), body, end)
+
+	l.block = body
+	l.lowerStmts(stmts)
+	if adv != nil {
+		l.lowerNode(adv)
+	}
+	l.jump(start)
+
+	l.block = end
+}
+
+func (l *lowerer) lowerBinOp(n *ast.Node) Temp {
+	if n.BinOp.Tag == ast.BinOpAssign {
+		val := l.lowerNode(n.BinOp.Rval)
+		slot := l.slotFor(n.BinOp.Lval.Id)
+		l.emit(Instr{
+			Op:   OpStore,
+			Type: l.fun.Slots[slot].Type,
+			Args: []Temp{val},
+			Slot: slot,
+		})
+		return val
+	}
+
+	// Operands are evaluated left to right
+	lval := l.lowerNode(n.BinOp.Lval)
+	rval := l.lowerNode(n.BinOp.Rval)
+	unsigned := isUnsigned(n.BinOp.Lval.GetTypeShallow(l.t))
+
+	i := Instr{Args: []Temp{lval, rval}}
+
+	switch n.BinOp.Tag {
+	case ast.BinOpArith:
+		i.Type = I64
+
+		switch n.BinOp.ArithTag {
+		case ast.BinOpSum:
+			i.Op = OpAdd
+		case ast.BinOpSub:
+			i.Op = OpSub
+		case ast.BinOpMult:
+			i.Op = OpMul
+		case ast.BinOpDiv:
+			i.Op = pick(unsigned, OpUDiv, OpSDiv)
+		case ast.BinOpMod:
+			i.Op = pick(unsigned, OpURem, OpSRem)
+		default:
+			panic("not implemented")
+		}
+
+	case ast.BinOpComp:
+		i.Type = I1
+
+		switch n.BinOp.CompTag {
+		case ast.BinOpEq:
+			i.Op = OpEq
+		case ast.BinOpNeq:
+			i.Op = OpNe
+		case ast.BinOpLessEq:
+			i.Op = pick(unsigned, OpULe, OpSLe)
+		case ast.BinOpLess:
+			i.Op = pick(unsigned, OpULt, OpSLt)
+		case ast.BinOpGreatEq:
+			i.Op = pick(unsigned, OpUGe, OpSGe)
+		case ast.BinOpGreat:
+			i.Op = pick(unsigned, OpUGt, OpSGt)
+		default:
+			panic("not implemented")
+		}
+
+	default:
+		panic("not implemented")
+	}
+
+	return l.emitValue(i)
+}
+
+func pick(cond bool, a Op, b Op) Op {
+	if cond {
+		return a
+	}
+	return b
+}
+
+// Integer types share their representation, so only conversions
+// to and from bool produce code.
+func (l *lowerer) lowerCast(n *ast.Node) Temp {
+	val := l.lowerNode(n.Cast.What)
+
+	from := lowerType(n.Cast.What.GetTypeShallow(l.t))
+	to := lowerType(n.Cast.To)
+
+	switch {
+	case from == Void:
+		panic("trying to cast from type 'void'")
+
+	case from == to:
+		return val
+
+	case from == I1 && to == I64:
+		return l.emitValue(Instr{Op: OpZext, Type: I64, Args: []Temp{val}})
+
+	case from == I64 && to == I1:
+		zero := l.emitValue(Instr{Op: OpConst, Type: I64, Imm: 0})
+		return l.emitValue(Instr{Op: OpNe, Type: I1, Args: []Temp{val, zero}})
+
+	default:
+		panic("not implemented")
+	}
+}
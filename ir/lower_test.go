@@ -0,0 +1,51 @@
+package ir
+
+import (
+	"clic/ast"
+	"clic/checker"
+	"clic/parser"
+	"clic/report"
+	"clic/resolver"
+	"clic/symbol"
+	"testing"
+)
+
+func check(t *testing.T, src string) ([]*ast.Node, *symbol.Table) {
+	tab := &symbol.Table{}
+	r := &report.Reporter{FileName: t.Name()}
+
+	asts := parser.New(src, r).CreateASTs()
+	resolver.Resolve(asts, tab, r)
+	checker.TypeCheck(asts, tab, r)
+	if r.HasErrors() {
+		t.Fatal("the program has errors")
+	}
+	return asts, tab
+}
+
+func TestLowerLocalExterns(t *testing.T) {
+	asts, tab := check(t, `
+(exfun print_bool (b: bool) void)
+(defun main () s64
+    (exfun print_s64 (n: s64) void)
+    (print_s64 1)
+    (if true
+        (exfun print_s64 (n: s64) void)
+        (exfun print_u64 (n: u64) void)
+        (print_u64 (u64 2)))
+    (print_bool true)
+    (return 0))
+`)
+
+	p := Lower(asts, tab, false)
+
+	want := []string{"print_bool", "print_s64", "print_u64"}
+	if len(p.Externs) != len(want) {
+		t.Fatalf("got %d externs, want %d", len(p.Externs), len(want))
+	}
+	for i, ext := range p.Externs {
+		if ext.Name != want[i] {
+			t.Errorf("extern %d is '%s', want '%s'", i, ext.Name, want[i])
+		}
+	}
+}
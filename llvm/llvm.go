@@ -0,0 +1,252 @@
+// This file contains the LLVM IR text backend. Slots become allocas
+// in the entry block, so 'opt' can promote them to registers.
+
+package llvm
+
+import (
+	"clic/ir"
+	"fmt"
+	"strings"
+)
+
+func Codegen(p *ir.Program) string {
+	code := ""
+
+	for _, ext := range p.Externs {
+		params := []string{}
+		for _, param := range ext.Params {
+			params = append(params, paramType(param))
+		}
+		code += fmt.Sprintf("declare %s @%s(%s)\n", retType(ext.Ret), ext.Name, strings.Join(params, ", "))
+	}
+
+	for _, f := range p.Funcs {
+		code += "\n"
+		code += genFunction(f)
+	}
+
+	return code
+}
+
+func typeName(t ir.Type) string {
+	switch t {
+	case ir.Void:
+		return "void"
+	case ir.I1:
+		return "i1"
+	case ir.I64:
+		return "i64"
+	default:
+		panic("not implemented")
+	}
+}
+
+// The C ABI passes bools zero extended
+func paramType(t ir.Type) string {
+	if t == ir.I1 {
+		return "i1 zeroext"
+	}
+	return typeName(t)
+}
+
+func retType(t ir.Type) string {
+	if t == ir.I1 {
+		return "zeroext i1"
+	}
+	return typeName(t)
+}
+
+var binOps = map[ir.Op]string{
+	ir.OpAdd:  "add",
+	ir.OpSub:  "sub",
+	ir.OpMul:  "mul",
+	ir.OpSDiv: "sdiv",
+	ir.OpUDiv: "udiv",
+	ir.OpSRem: "srem",
+	ir.OpURem: "urem",
+}
+
+var compConds = map[ir.Op]string{
+	ir.OpEq:  "eq",
+	ir.OpNe:  "ne",
+	ir.OpSLt: "slt",
+	ir.OpSLe: "sle",
+	ir.OpSGt: "sgt",
+	ir.OpSGe: "sge",
+	ir.OpULt: "ult",
+	ir.OpULe: "ule",
+	ir.OpUGt: "ugt",
+	ir.OpUGe: "uge",
+}
+
+type function struct {
+	f *ir.Func
+
+	// Operands of the temporaries. Constants and copies are not
+	// instructions in LLVM, so they are used directly.
+	values []string
+}
+
+func genFunction(f *ir.Func) string {
+	fn := function{f: f, values: make([]string, len(f.Temps))}
+	for t := range f.Temps {
+		fn.values[t] = fmt.Sprintf("%%t%d", t)
+	}
+
+	// 'main' returns an int to the C runtime
+	ret := retType(f.Ret)
+	if fn.isMain() {
+		ret = "i32"
+	}
+
+	params := []string{}
+	for i, slot := range f.Params {
+		params = append(params, fmt.Sprintf("%s %%p%d", paramType(f.Slots[slot].Type), i))
+	}
+
+	code := fmt.Sprintf("define %s @%s(%s) {\n", ret, f.Name, strings.Join(params, ", "))
+
+	// The entry block of LLVM can't be jumped to, ours can
+	code += "entry:\n"
+	for slot, info := range f.Slots {
+		code += fmt.Sprintf("\t%s = alloca %s\n", fn.slot(ir.Slot(slot)), typeName(info.Type))
+	}
+	for i, slot := range f.Params {
+		typ := typeName(f.Slots[slot].Type)
+		code += fmt.Sprintf("\tstore %s %%p%d, ptr %s\n", typ, i, fn.slot(slot))
+	}
+	code += "\tbr label %b0\n"
+
+	for id, block := range f.Blocks {
+		code += fmt.Sprintf("b%d:\n", id)
+		for _, instr := range block.Instrs {
+			code += fn.genInstr(ir.BlockId(id), &instr)
+		}
+	}
+
+	code += "}\n"
+	return code
+}
+
+func (fn *function) isMain() bool {
+	return fn.f.Name == "main" && fn.f.Ret != ir.Void
+}
+
+// Returns the result of 'main' as the int of the C runtime
+func (fn *function) mainRet(b ir.BlockId, typ ir.Type, value string) string {
+	conv := "trunc"
+	if typ == ir.I1 {
+		conv = "zext"
+	}
+	code := fmt.Sprintf("\t%%ret.%d = %s %s %s to i32\n", b, conv, typeName(typ), value)
+	return code + fmt.Sprintf("\tret i32 %%ret.%d\n", b)
+}
+
+func (fn *function) slot(slot ir.Slot) string {
+	return fmt.Sprintf("%%%s.%d", fn.f.Slots[slot].Name, slot)
+}
+
+func (fn *function) arg(t ir.Temp) string {
+	return typeName(fn.f.Temps[t]) + " " + fn.values[t]
+}
+
+func (fn *function) args(i *ir.Instr) string {
+	args := []string{}
+	for _, arg := range i.Args {
+		typ := paramType(fn.f.Temps[arg])
+		args = append(args, typ+" "+fn.values[arg])
+	}
+	return strings.Join(args, ", ")
+}
+
+func (fn *function) genInstr(b ir.BlockId, i *ir.Instr) string {
+	dst := ""
+	if i.Dst != ir.TempNone {
+		dst = fn.values[i.Dst]
+	}
+
+	switch i.Op {
+	case ir.OpConst:
+		if i.Type == ir.I1 {
+			fn.values[i.Dst] = fmt.Sprint(i.Imm != 0)
+		} else {
+			fn.values[i.Dst] = fmt.Sprint(i.Imm)
+		}
+		return ""
+
+	case ir.OpCopy:
+		fn.values[i.Dst] = fn.values[i.Args[0]]
+		return ""
+
+	case ir.OpLoad:
+		return fmt.Sprintf("\t%s = load %s, ptr %s\n", dst, typeName(i.Type), fn.slot(i.Slot))
+
+	case ir.OpStore:
+		return fmt.Sprintf("\tstore %s, ptr %s\n", fn.arg(i.Args[0]), fn.slot(i.Slot))
+
+	case ir.OpAdd, ir.OpSub, ir.OpMul, ir.OpSDiv, ir.OpUDiv, ir.OpSRem, ir.OpURem:
+		return fmt.Sprintf("\t%s = %s %s, %s\n", dst, binOps[i.Op],
+			fn.arg(i.Args[0]), fn.values[i.Args[1]])
+
+	case ir.OpEq, ir.OpNe, ir.OpSLt, ir.OpSLe, ir.OpSGt, ir.OpSGe,
+		ir.OpULt, ir.OpULe, ir.OpUGt, ir.OpUGe:
+		return fmt.Sprintf("\t%s = icmp %s %s, %s\n", dst, compConds[i.Op],
+			fn.arg(i.Args[0]), fn.values[i.Args[1]])
+
+	case ir.OpZext:
+		return fmt.Sprintf("\t%s = zext %s to i64\n", dst, fn.arg(i.Args[0]))
+
+	case ir.OpCall:
+		call := fmt.Sprintf("call %s @%s(%s)", retType(i.Type), i.Fun, fn.args(i))
+		if dst == "" {
+			return "\t" + call + "\n"
+		}
+		return fmt.Sprintf("\t%s = %s\n", dst, call)
+
+	// Inline assembly for x86_64 Linux, the registers follow
+	// 'syscallRegs' of the codegen
+	case ir.OpSyscall:
+		regs := []string{"{rax}", "{rdi}", "{rsi}", "{rdx}", "{r10}", "{r8}", "{r9}"}
+		constraints := "={rax}," + strings.Join(regs[:len(i.Args)], ",") + ",~{rcx},~{r11},~{memory}"
+		return fmt.Sprintf("\t%s = call i64 asm sideeffect \"syscall\", \"%s\"(%s)\n",
+			dst, constraints, fn.args(i))
+
+	case ir.OpJump:
+		return fmt.Sprintf("\tbr label %%b%d\n", i.Targets[0])
+
+	case ir.OpBranch:
+		return fmt.Sprintf("\tbr %s, label %%b%d, label %%b%d\n",
+			fn.arg(i.Args[0]), i.Targets[0], i.Targets[1])
+
+	// The IR ends every function with a return, which can't be
+	// reached when the body returns a value on every path
+	case ir.OpRet:
+		if len(i.Args) == 0 {
+			if fn.f.Ret != ir.Void {
+				return "\tunreachable\n"
+			}
+			return "\tret void\n"
+		}
+		if fn.isMain() {
+			return fn.mainRet(b, fn.f.Temps[i.Args[0]], fn.values[i.Args[0]])
+		}
+		return fmt.Sprintf("\tret %s\n", fn.arg(i.Args[0]))
+
+	// Only a hint, 'musttail' needs the signatures to match
+	case ir.OpTailCall:
+		call := fmt.Sprintf("tail call %s @%s(%s)", retType(i.Type), i.Fun, fn.args(i))
+		if i.Type == ir.Void {
+			return "\t" + call + "\n\tret void\n"
+		}
+
+		result := fmt.Sprintf("%%tail.%d", b)
+		code := fmt.Sprintf("\t%s = %s\n", result, call)
+		if fn.isMain() {
+			return code + fn.mainRet(b, i.Type, result)
+		}
+		return code + fmt.Sprintf("\tret %s %s\n", typeName(i.Type), result)
+
+	default:
+		panic("not implemented")
+	}
+}
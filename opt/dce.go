@@ -0,0 +1,127 @@
+// This file contains dead code elimination. Statements that can
+// never run are removed from the AST, functions that can never be
+// called are removed from the IR, after inlining made some of them
+// unused.
+
+package opt
+
+import (
+	"clic/ast"
+	"clic/ir"
+)
+
+func DeadCode(roots []*ast.Node) {
+	for _, node := range roots {
+		if node.Tag == ast.NodeFunDef {
+			node.Fun.Stmts, _ = liveStmts(node.Fun.Stmts)
+		}
+	}
+}
+
+// Returns the statements that can run and whether control never
+// reaches the end of the list
+func liveStmts(stmts []*ast.Node) ([]*ast.Node, bool) {
+	live := []*ast.Node{}
+
+	for _, stmt := range stmts {
+		done := liveNode(stmt)
+		live = append(live, stmt)
+		if done {
+			return live, true
+		}
+	}
+
+	return live, false
+}
+
+func liveNode(n *ast.Node) bool {
+	if pruneConst(n) {
+		return liveNode(n)
+	}
+
+	switch n.Tag {
+	case ast.NodeReturn:
+		return true
+
+	case ast.NodeScope:
+		done := false
+		n.Scope.Stmts, done = liveStmts(n.Scope.Stmts)
+		return done
+
+	case ast.NodeIf:
+		ifDone, elseDone := false, false
+		n.If.IfStmts, ifDone = liveStmts(n.If.IfStmts)
+		n.If.ElseStmts, elseDone = liveStmts(n.If.ElseStmts)
+		return ifDone && elseDone
+
+	case ast.NodeWhile:
+		// There is no 'break', see 'checker'
+		n.While.Stmts, _ = liveStmts(n.While.Stmts)
+		return isConst(n.While.Exp)
+
+	case ast.NodeFor:
+		n.For.Stmts, _ = liveStmts(n.For.Stmts)
+		return isConst(n.For.Cond)
+
+	default:
+		return false
+	}
+}
+
+// Removes the functions and externs that can't be reached from the
+// entry points
+func DeadFuncs(p *ir.Program) {
+	funcs := map[string]*ir.Func{}
+	reached := map[string]bool{}
+	work := []*ir.Func{}
+
+	for _, f := range p.Funcs {
+		funcs[f.Name] = f
+		if isEntry(f) {
+			reached[f.Name] = true
+			work = append(work, f)
+		}
+	}
+
+	for len(work) > 0 {
+		f := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		for _, block := range f.Blocks {
+			for _, i := range block.Instrs {
+				if i.Op != ir.OpCall && i.Op != ir.OpTailCall {
+					continue
+				}
+				if reached[i.Fun] {
+					continue
+				}
+
+				reached[i.Fun] = true
+				if callee, ok := funcs[i.Fun]; ok {
+					work = append(work, callee)
+				}
+			}
+		}
+	}
+
+	live := []*ir.Func{}
+	for _, f := range p.Funcs {
+		if reached[f.Name] {
+			live = append(live, f)
+		}
+	}
+	p.Funcs = live
+
+	externs := []ir.Extern{}
+	for _, ext := range p.Externs {
+		if reached[ext.Name] {
+			externs = append(externs, ext)
+		}
+	}
+	p.Externs = externs
+}
+
+// Exported functions can be called from other objects
+func isEntry(f *ir.Func) bool {
+	return f.Name == "main" || f.Export
+}
@@ -0,0 +1,330 @@
+// This file contains the constant folding and propagation pass. It
+// runs on the checked AST and rewrites nodes in place.
+
+package opt
+
+import (
+	"clic/ast"
+	"clic/report"
+	"clic/symbol"
+	"clic/types"
+)
+
+type folder struct {
+	t *symbol.Table
+	r *report.Reporter
+
+	// Variables that appear on the left of ':=' in the function
+	assigned map[symbol.Id]bool
+
+	// Values of 'auto' variables that are never assigned again
+	consts map[symbol.Id]*ast.Node
+}
+
+func Fold(roots []*ast.Node, t *symbol.Table, r *report.Reporter) {
+	for _, node := range roots {
+		if node.Tag != ast.NodeFunDef {
+			continue
+		}
+
+		f := folder{
+			t:        t,
+			r:        r,
+			assigned: make(map[symbol.Id]bool),
+			consts:   make(map[symbol.Id]*ast.Node),
+		}
+
+		ast.Walk(node, func(n *ast.Node) {
+			isAssign := (n.Tag == ast.NodeBinOp) && (n.BinOp.Tag == ast.BinOpAssign)
+			if isAssign && n.BinOp.Lval.Tag == ast.NodeLVar {
+				f.assigned[n.BinOp.Lval.Id] = true
+			}
+		})
+
+		f.foldStmts(node.Fun.Stmts)
+	}
+}
+
+func (f *folder) foldStmts(stmts []*ast.Node) {
+	for _, stmt := range stmts {
+		f.foldNode(stmt)
+	}
+}
+
+func (f *folder) foldNode(n *ast.Node) {
+	switch n.Tag {
+	case ast.NodeLVar:
+		c, ok := f.consts[n.Id]
+		if ok {
+			line, column := n.Line, n.Column
+			*n = *copyConst(c)
+			n.Line, n.Column = line, column
+		}
+
+	case ast.NodeBinOp:
+		if n.BinOp.Tag == ast.BinOpAssign {
+			// The left side is a storage location, not a value
+			f.foldNode(n.BinOp.Rval)
+
+			lval := n.BinOp.Lval
+			if lval.Tag == ast.NodeLVarDecl && !f.assigned[lval.Id] && isConst(n.BinOp.Rval) {
+				f.consts[lval.Id] = n.BinOp.Rval
+			}
+			return
+		}
+
+		f.foldNode(n.BinOp.Lval)
+		f.foldNode(n.BinOp.Rval)
+		f.foldBinOp(n)
+
+	case ast.NodeCast:
+		f.foldNode(n.Cast.What)
+
+		if isConst(n.Cast.What) {
+			value := constValue(n.Cast.What)
+			from := n.Cast.What.GetTypeDeep(f.t)
+			to := n.Cast.To.Underlying()
+
+			if from != types.GetBuiltin(types.Bool) && to == types.GetBuiltin(types.Bool) {
+				if value != 0 {
+					value = 1
+				}
+			}
+
+			*n = *makeConst(value, n.Cast.To, n)
+		}
+
+	case ast.NodeIf:
+		f.foldNode(n.If.Exp)
+		f.foldStmts(n.If.IfStmts)
+		f.foldStmts(n.If.ElseStmts)
+		pruneConst(n)
+
+	case ast.NodeWhile:
+		f.foldNode(n.While.Exp)
+		f.foldStmts(n.While.Stmts)
+		pruneConst(n)
+
+	case ast.NodeFor:
+		f.foldNode(n.For.Init)
+		f.foldNode(n.For.Cond)
+		f.foldNode(n.For.Adv)
+		f.foldStmts(n.For.Stmts)
+		pruneConst(n)
+
+	default:
+		for _, child := range n.Children() {
+			f.foldNode(child)
+		}
+	}
+}
+
+func (f *folder) foldBinOp(n *ast.Node) {
+	// Literal zero divisors are errors in 'checker', these are the
+	// ones that only fold to zero
+	arith := n.BinOp.ArithTag
+	isDivision := n.BinOp.Tag == ast.BinOpArith && (arith == ast.BinOpDiv || arith == ast.BinOpMod)
+	if isDivision && isConst(n.BinOp.Rval) && constValue(n.BinOp.Rval) == 0 {
+		n.ReportHere(f.r, report.ReportNonfatal, "division by zero")
+		return
+	}
+
+	if !isConst(n.BinOp.Lval) || !isConst(n.BinOp.Rval) {
+		return
+	}
+
+	lval := constValue(n.BinOp.Lval)
+	rval := constValue(n.BinOp.Rval)
+	unsigned := n.BinOp.Lval.GetTypeDeep(f.t) == types.GetBuiltin(types.U64)
+
+	value := uint64(0)
+
+	switch n.BinOp.Tag {
+	case ast.BinOpArith:
+		switch n.BinOp.ArithTag {
+		case ast.BinOpSum:
+			value = lval + rval
+		case ast.BinOpSub:
+			value = lval - rval
+		case ast.BinOpMult:
+			value = lval * rval
+
+		case ast.BinOpDiv, ast.BinOpMod:
+			isDiv := (n.BinOp.ArithTag == ast.BinOpDiv)
+			switch {
+			case unsigned && isDiv:
+				value = lval / rval
+			case unsigned:
+				value = lval % rval
+			case isDiv:
+				value = uint64(int64(lval) / int64(rval))
+			default:
+				value = uint64(int64(lval) % int64(rval))
+			}
+
+		default:
+			panic("not implemented")
+		}
+
+	case ast.BinOpComp:
+		result := false
+
+		switch n.BinOp.CompTag {
+		case ast.BinOpEq:
+			result = lval == rval
+		case ast.BinOpNeq:
+			result = lval != rval
+		case ast.BinOpLessEq:
+			result = pick(unsigned, lval <= rval, int64(lval) <= int64(rval))
+		case ast.BinOpLess:
+			result = pick(unsigned, lval < rval, int64(lval) < int64(rval))
+		case ast.BinOpGreatEq:
+			result = pick(unsigned, lval >= rval, int64(lval) >= int64(rval))
+		case ast.BinOpGreat:
+			result = pick(unsigned, lval > rval, int64(lval) > int64(rval))
+		default:
+			panic("not implemented")
+		}
+
+		if result {
+			value = 1
+		}
+
+	default:
+		panic("not implemented")
+	}
+
+	*n = *makeConst(value, n.GetTypeShallow(f.t), n)
+}
+
+func pick(cond bool, a bool, b bool) bool {
+	if cond {
+		return a
+	}
+	return b
+}
+
+// Constants are literals, possibly cast to a type defined with
+// 'typedef' so the folded node keeps its type.
+// Replaces an if or a loop that has a constant condition with the
+// statements that run. Names are already resolved, so a scope is
+// only a list of statements now. Returns whether 'n' changed.
+func pruneConst(n *ast.Node) bool {
+	tag := ast.NodeScope
+	stmts := []*ast.Node{}
+
+	switch {
+	case n.Tag == ast.NodeIf && isConst(n.If.Exp):
+		stmts = n.If.ElseStmts
+		if constValue(n.If.Exp) != 0 {
+			stmts = n.If.IfStmts
+		}
+
+	case n.Tag == ast.NodeWhile && isConst(n.While.Exp) && constValue(n.While.Exp) == 0:
+		tag = ast.NodeEmpty
+
+	case n.Tag == ast.NodeFor && isConst(n.For.Cond) && constValue(n.For.Cond) == 0:
+		stmts = []*ast.Node{n.For.Init}
+
+	default:
+		return false
+	}
+
+	*n = ast.Node{
+		Tag:    tag,
+		Id:     symbol.IdNone,
+		Line:   n.Line,
+		Column: n.Column,
+	}
+	n.Scope.Stmts = stmts
+	return true
+}
+
+func isConst(n *ast.Node) bool {
+	switch n.Tag {
+	case ast.NodeInt, ast.NodeBool:
+		return true
+	case ast.NodeCast:
+		what := n.Cast.What
+		return what.Tag == ast.NodeInt || what.Tag == ast.NodeBool
+	default:
+		return false
+	}
+}
+
+// Returns the bits of the constant
+func constValue(n *ast.Node) uint64 {
+	switch n.Tag {
+	case ast.NodeInt:
+		if n.Int.Signed {
+			return uint64(n.Int.SValue)
+		}
+		return n.Int.UValue
+
+	case ast.NodeBool:
+		if n.Bool.Value {
+			return 1
+		}
+		return 0
+
+	case ast.NodeCast:
+		return constValue(n.Cast.What)
+
+	default:
+		panic("not a constant")
+	}
+}
+
+func makeConst(value uint64, typ types.Id, pos *ast.Node) *ast.Node {
+	n := &ast.Node{
+		Id:     symbol.IdNone,
+		Line:   pos.Line,
+		Column: pos.Column,
+	}
+
+	underlying := typ.Underlying()
+
+	switch underlying {
+	case types.GetBuiltin(types.S64):
+		n.Tag = ast.NodeInt
+		n.Int.Size = 64
+		n.Int.Signed = true
+		n.Int.SValue = int64(value)
+
+	case types.GetBuiltin(types.U64):
+		n.Tag = ast.NodeInt
+		n.Int.Size = 64
+		n.Int.Signed = false
+		n.Int.UValue = value
+
+	case types.GetBuiltin(types.Bool):
+		n.Tag = ast.NodeBool
+		n.Bool.Value = (value != 0)
+
+	default:
+		panic("not implemented")
+	}
+
+	if typ == underlying {
+		return n
+	}
+
+	cast := &ast.Node{
+		Tag:    ast.NodeCast,
+		Id:     symbol.IdNone,
+		Line:   pos.Line,
+		Column: pos.Column,
+	}
+	cast.Cast.To = typ
+	cast.Cast.What = n
+	return cast
+}
+
+func copyConst(n *ast.Node) *ast.Node {
+	c := *n
+	if n.Tag == ast.NodeCast {
+		what := *n.Cast.What
+		c.Cast.What = &what
+	}
+	return &c
+}
@@ -0,0 +1,263 @@
+// This file contains the function inliner. It works on the IR,
+// where a call in the middle of an expression can be split into
+// blocks.
+
+package opt
+
+import (
+	"clic/ir"
+)
+
+// Callees with at most this many instructions are inlined without
+// the 'inline' attribute.
+const inlineThreshold = 16
+
+func Inline(p *ir.Program) {
+	// Callees are inlined as they were before the pass
+	originals := map[string]*ir.Func{}
+	for _, f := range p.Funcs {
+		originals[f.Name] = cloneFunc(f)
+	}
+
+	for _, f := range p.Funcs {
+		// Calls in inlined code are left alone, otherwise mutual
+		// recursion would expand forever.
+		inlined := map[int]bool{}
+
+		for b := 0; b < len(f.Blocks); b++ {
+			if inlined[b] {
+				continue
+			}
+
+			for k := 0; k < len(f.Blocks[b].Instrs); k++ {
+				i := &f.Blocks[b].Instrs[k]
+				if i.Op != ir.OpCall && i.Op != ir.OpTailCall {
+					continue
+				}
+
+				callee, ok := originals[i.Fun]
+				if ok && callee.Name != f.Name && shouldInline(callee) {
+					first := len(f.Blocks) + 1
+					inlineCall(f, ir.BlockId(b), k, callee)
+					for id := first; id < len(f.Blocks); id++ {
+						inlined[id] = true
+					}
+					// The rest of the block moved to a new block
+					break
+				}
+			}
+		}
+
+		f.RemoveUnreachable()
+	}
+}
+
+func shouldInline(f *ir.Func) bool {
+	switch f.Inline {
+	case ir.InlineAlways:
+		return true
+
+	case ir.InlineNever:
+		return false
+	}
+
+	size := 0
+	for _, block := range f.Blocks {
+		size += len(block.Instrs)
+	}
+	return size <= inlineThreshold
+}
+
+// Splits the block at the call:
+//
+//	before, stores of the arguments, jump to the callee entry
+//	callee blocks, returns store the result and jump to 'cont'
+//	cont: loads, the rest of the block
+//
+// Temporaries can't outlive their block, so values that are used
+// after the call go through new slots.
+//
+// A tail call ends the block, so the callee returns for the caller
+// and its own tail calls stay tail calls.
+func inlineCall(f *ir.Func, b ir.BlockId, k int, callee *ir.Func) {
+	block := f.Blocks[b]
+	call := block.Instrs[k]
+	tail := (call.Op == ir.OpTailCall)
+	before := append([]ir.Instr{}, block.Instrs[:k]...)
+	after := append([]ir.Instr{}, block.Instrs[k+1:]...)
+
+	// Temporaries defined before the call and used after it
+	crossing := map[ir.Temp]bool{}
+	for _, i := range before {
+		if i.Dst != ir.TempNone {
+			crossing[i.Dst] = false
+		}
+	}
+	for _, i := range after {
+		for _, arg := range i.Args {
+			if _, ok := crossing[arg]; ok {
+				crossing[arg] = true
+			}
+		}
+	}
+
+	cont := f.NewBlock()
+	contInstrs := []ir.Instr{}
+	renames := map[ir.Temp]ir.Temp{}
+
+	// Walking 'before' to keep the order deterministic
+	for _, i := range before {
+		if i.Dst == ir.TempNone || !crossing[i.Dst] {
+			continue
+		}
+
+		typ := f.Temps[i.Dst]
+		slot := f.NewSlot("tmp", typ)
+		before = append(before, ir.Instr{
+			Op:   ir.OpStore,
+			Type: typ,
+			Dst:  ir.TempNone,
+			Args: []ir.Temp{i.Dst},
+			Slot: slot,
+		})
+
+		renamed := f.NewTemp(typ)
+		renames[i.Dst] = renamed
+		contInstrs = append(contInstrs, ir.Instr{
+			Op:   ir.OpLoad,
+			Type: typ,
+			Dst:  renamed,
+			Slot: slot,
+		})
+	}
+
+	for _, i := range after {
+		for j, arg := range i.Args {
+			if renamed, ok := renames[arg]; ok {
+				i.Args[j] = renamed
+			}
+		}
+		contInstrs = append(contInstrs, i)
+	}
+
+	// Copying the callee with fresh temporaries, slots and blocks
+	tempBase := ir.Temp(len(f.Temps))
+	slotBase := ir.Slot(len(f.Slots))
+	blockBase := ir.BlockId(len(f.Blocks))
+
+	f.Temps = append(f.Temps, callee.Temps...)
+	for _, slot := range callee.Slots {
+		f.NewSlot(callee.Name+"."+slot.Name, slot.Type)
+	}
+
+	result := ir.Slot(-1)
+	if call.Dst != ir.TempNone {
+		result = f.NewSlot(callee.Name+".result", call.Type)
+		contInstrs = append([]ir.Instr{{
+			Op:   ir.OpLoad,
+			Type: call.Type,
+			Dst:  call.Dst,
+			Slot: result,
+		}}, contInstrs...)
+	}
+
+	for _, calleeBlock := range cloneFunc(callee).Blocks {
+		instrs := []ir.Instr{}
+
+		for _, i := range calleeBlock.Instrs {
+			if i.Dst != ir.TempNone {
+				i.Dst += tempBase
+			}
+			for j := range i.Args {
+				i.Args[j] += tempBase
+			}
+			for j := range i.Targets {
+				i.Targets[j] += blockBase
+			}
+			if i.Op == ir.OpLoad || i.Op == ir.OpStore {
+				i.Slot += slotBase
+			}
+
+			// Not a tail call anymore once it's in the caller
+			if i.Op == ir.OpTailCall && !tail {
+				call, ret := splitTailCall(f, i)
+				instrs = append(instrs, call)
+				i = ret
+			}
+
+			if i.Op == ir.OpRet && !tail {
+				if result != -1 {
+					instrs = append(instrs, ir.Instr{
+						Op:   ir.OpStore,
+						Type: call.Type,
+						Dst:  ir.TempNone,
+						Args: i.Args,
+						Slot: result,
+					})
+				}
+				i = ir.Instr{
+					Op:      ir.OpJump,
+					Dst:     ir.TempNone,
+					Targets: []ir.BlockId{cont},
+				}
+			}
+
+			instrs = append(instrs, i)
+		}
+
+		f.Blocks = append(f.Blocks, &ir.Block{Instrs: instrs})
+	}
+
+	for j, param := range callee.Params {
+		before = append(before, ir.Instr{
+			Op:   ir.OpStore,
+			Type: callee.Slots[param].Type,
+			Dst:  ir.TempNone,
+			Args: []ir.Temp{call.Args[j]},
+			Slot: param + slotBase,
+		})
+	}
+	before = append(before, ir.Instr{
+		Op:      ir.OpJump,
+		Dst:     ir.TempNone,
+		Targets: []ir.BlockId{blockBase},
+	})
+
+	block.Instrs = before
+	f.Blocks[cont].Instrs = contInstrs
+}
+
+// Turns a tail call into a call followed by a return of its result
+func splitTailCall(f *ir.Func, i ir.Instr) (ir.Instr, ir.Instr) {
+	call := i
+	call.Op = ir.OpCall
+	if call.Type != ir.Void {
+		call.Dst = f.NewTemp(call.Type)
+	}
+
+	ret := ir.Instr{Op: ir.OpRet, Dst: ir.TempNone}
+	if call.Dst != ir.TempNone {
+		ret.Args = []ir.Temp{call.Dst}
+	}
+	return call, ret
+}
+
+func cloneFunc(f *ir.Func) *ir.Func {
+	c := *f
+	c.Params = append([]ir.Slot{}, f.Params...)
+	c.Slots = append([]ir.SlotInfo{}, f.Slots...)
+	c.Temps = append([]ir.Type{}, f.Temps...)
+	c.Blocks = nil
+
+	for _, block := range f.Blocks {
+		instrs := []ir.Instr{}
+		for _, i := range block.Instrs {
+			i.Args = append([]ir.Temp{}, i.Args...)
+			i.Targets = append([]ir.BlockId{}, i.Targets...)
+			instrs = append(instrs, i)
+		}
+		c.Blocks = append(c.Blocks, &ir.Block{Instrs: instrs})
+	}
+
+	return &c
+}
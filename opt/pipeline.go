@@ -0,0 +1,110 @@
+// This file contains the selection of optimization passes.
+
+package opt
+
+import (
+	"clic/ast"
+	"clic/ir"
+	"clic/report"
+	"clic/symbol"
+	"fmt"
+	"strings"
+)
+
+type Pass uint
+
+const (
+	passError Pass = iota
+	PassFold
+	PassRegalloc
+	PassPeephole
+	PassInline
+	PassDCE
+	PassTailCall
+	passCount
+)
+
+var passNames = [passCount]string{
+	PassFold:     "fold",
+	PassRegalloc: "regalloc",
+	PassPeephole: "peephole",
+	PassInline:   "inline",
+	PassDCE:      "dce",
+	PassTailCall: "tailcall",
+}
+
+// Passes enabled by each -O level
+var levels = [...][]Pass{
+	0: {},
+	1: {PassFold, PassRegalloc, PassPeephole, PassDCE, PassTailCall},
+	2: {PassFold, PassRegalloc, PassPeephole, PassDCE, PassTailCall, PassInline},
+}
+
+const MaxLevel = len(levels) - 1
+
+type Pipeline struct {
+	enabled [passCount]bool
+}
+
+func NewPipeline(level int) Pipeline {
+	if level < 0 || level > MaxLevel {
+		panic("optimization level out of range")
+	}
+
+	p := Pipeline{}
+	for _, pass := range levels[level] {
+		p.enabled[pass] = true
+	}
+	return p
+}
+
+// Takes a comma separated list of pass names. Used to turn single
+// passes on and off when looking for a miscompile.
+func (p *Pipeline) Toggle(names string, on bool) error {
+	if names == "" {
+		return nil
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		found := false
+		for pass := Pass(1); pass < passCount; pass++ {
+			if passNames[pass] == name {
+				p.enabled[pass] = on
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown pass '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+func (p Pipeline) Has(pass Pass) bool {
+	return p.enabled[pass]
+}
+
+// Runs the enabled passes that work on the checked AST
+func (p Pipeline) Run(roots []*ast.Node, t *symbol.Table, r *report.Reporter) {
+	if p.Has(PassFold) {
+		Fold(roots, t, r)
+	}
+	if p.Has(PassDCE) {
+		DeadCode(roots)
+	}
+}
+
+// Runs the enabled passes that work on the IR
+func (p Pipeline) RunIR(prog *ir.Program) {
+	if p.Has(PassInline) {
+		Inline(prog)
+	}
+	if p.Has(PassDCE) {
+		DeadFuncs(prog)
+	}
+}
+
+func PassNames() string {
+	return strings.Join(passNames[1:], ", ")
+}
@@ -60,7 +60,7 @@ var tokenPatterns = []struct {
 }{
 	// Order matters!
 
-	{tokenKeyword, regexp.MustCompile(`^(\blet\b|\bdefun\b|\bexfun\b|\breturn\b|\bif\b|\belse\b|\bwhile\b|\btrue\b|\bfalse\b|\bauto\b|\btypedef\b|\bfor\b)`), true},
+	{tokenKeyword, regexp.MustCompile(`^(\blet\b|\bdefun\b|\bexfun\b|\breturn\b|\bif\b|\belse\b|\bwhile\b|\btrue\b|\bfalse\b|\bauto\b|\btypedef\b|\bfor\b|\binline\b|\bnoinline\b|\bexport\b|\btailcall\b|\bsyscall\b)`), true},
 	{tokenType, regexp.MustCompile(`^(\bvoid\b|\bs64\b|\bu64\b|\bbool\b|\bstruct\b)`), true},
 	{tokenInt, regexp.MustCompile(`^(-?[1-9]+[0-9]*|0)`), true},
 	{tokenBinOp, regexp.MustCompile(`^(:=|==|!=|<=|<|>=|>|-|\+|\*|/|%)`), true},
@@ -69,7 +69,7 @@ var tokenPatterns = []struct {
 	{tokenTag(')'), regexp.MustCompile(`^\)`), false},
 	{tokenTag(':'), regexp.MustCompile(`^:`), false},
 
-	{tokenIdent, regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*`), true},
+	{tokenIdent, regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`), true},
 }
 
 func (tag tokenTag) stringify() string {
@@ -19,14 +19,12 @@ const (
 
 type Parser struct {
 	l lexer
-	t *symbol.Table
 	r *report.Reporter
 
-	state    parserState
-	function symbol.Id
+	state parserState
 }
 
-func New(data string, t *symbol.Table, r *report.Reporter) *Parser {
+func New(data string, r *report.Reporter) *Parser {
 	return &Parser{
 		l: lexer{
 			data:     data,
@@ -35,7 +33,6 @@ func New(data string, t *symbol.Table, r *report.Reporter) *Parser {
 			writeInd: 0,
 			readInd:  0,
 		},
-		t:     t,
 		r:     r,
 		state: inGlobal,
 	}
@@ -44,7 +41,6 @@ func New(data string, t *symbol.Table, r *report.Reporter) *Parser {
 func (p *Parser) CreateASTs() []*ast.Node {
 	var roots []*ast.Node
 
-	p.t.PushScope()
 	for {
 		lookahead := p.peek(0)
 		if lookahead.tag == tokenEOF {
@@ -54,7 +50,6 @@ func (p *Parser) CreateASTs() []*ast.Node {
 		node := p.parseList()
 		roots = append(roots, node)
 	}
-	p.t.PopScope()
 
 	return roots
 }
@@ -80,14 +75,10 @@ func (p *Parser) parseList() *ast.Node {
 	case tokenTag('('):
 		n.Tag = ast.NodeScope
 
-		p.t.PushScope()
-
 		for p.peek(0).tag == tokenTag('(') {
 			n.Scope.Stmts = append(n.Scope.Stmts, p.parseList())
 		}
 
-		p.t.PopScope()
-
 	case tokenKeyword:
 		switch p.consume().data {
 		case "let":
@@ -97,22 +88,10 @@ func (p *Parser) parseList() *ast.Node {
 				panic("not implemented")
 			}
 
-			name, typ := p.parseNameWithType()
-
-			id, added := p.t.Add(name, symbol.LVar)
-
-			if added {
-				n.Id = id
-				sym := p.t.Get(id)
-				sym.Type = typ
-				p.t.Set(id, sym)
-			} else {
-				n.ReportHere(p.r, report.ReportNonfatal,
-					"local variable is already declared in the current scope")
-			}
+			n.Name, n.LVarDecl.Type = p.parseNameWithType()
 
 		case "auto":
-			// Type is inferred.
+			// Type is inferred in 'resolver'.
 			//              n
 			//             / \
 			// new variable   item
@@ -125,163 +104,52 @@ func (p *Parser) parseList() *ast.Node {
 			n.BinOp.Tag = ast.BinOpAssign
 
 			ident := p.match(tokenIdent)
-			name := ident.data
 
 			// TODO: Check if the identifier is not a type
 			// or something
 			rval := p.parseItem()
 			n.BinOp.Rval = rval
 
-			id, added := p.t.Add(name, symbol.LVar)
-
-			if added {
-				lval := ast.Node{
-					Tag:    ast.NodeLVarDecl,
-					Id:     id,
-					Line:   ident.line,
-					Column: ident.column,
-				}
-
-				sym := p.t.Get(id)
-				// Type is determined in the parser, so it should be
-				// known by now.
-				sym.Type = rval.GetTypeShallow(p.t)
-				p.t.Set(id, sym)
-
-				n.BinOp.Lval = &lval
-			} else {
-				n.ReportHere(p.r, report.ReportNonfatal,
-					"local variable is already declared in the current scope")
+			lval := ast.Node{
+				Tag:    ast.NodeLVarDecl,
+				Id:     symbol.IdNone,
+				Line:   ident.line,
+				Column: ident.column,
+				Name:   ident.data,
 			}
+			lval.LVarDecl.Type = types.IdNone
+
+			n.BinOp.Lval = &lval
 
 		case "exfun":
 			n.Tag = ast.NodeFunEx
 
-			name := p.match(tokenIdent).data
-
-			params := []symbol.TypedIdent{}
-			p.match(tokenTag('('))
-			for p.peek(0).tag != tokenTag(')') {
-				param := symbol.TypedIdent{}
-				param.Name, param.Type = p.parseNameWithType()
-				params = append(params, param)
-			}
-			p.match(tokenTag(')'))
-
-			typ := p.parseType()
-
-			id, added := p.t.Add(name, symbol.Fun)
-
-			if added {
-				n.Id = id
-				sym := p.t.Get(id)
-				sym.Type = typ
-				sym.Fun.Params = params
-				p.t.Set(id, sym)
-			} else {
-				n.ReportHere(p.r, report.ReportNonfatal,
-					"function is already declared")
-			}
+			n.Name = p.match(tokenIdent).data
+			n.Fun.ParamDecls = p.parseParams()
+			n.Fun.Type = p.parseType()
 
 		case "defun":
-			funName := p.match(tokenIdent).data
-			funId, funAdded := p.t.Add(funName, symbol.Fun)
-
-			p.t.PushScope()
+			n.Name = p.match(tokenIdent).data
 
-			// Adding parameters as local variables, so they can be
-			// seen in the scope. Keeping their ids so codegen can
-			// assign offsets. Also adding parameters to the symbol
-			// table so they can be seen in a call.
+			// Parameters are added to the symbol table in
+			// 'resolver', both as local variables of the
+			// function and as the signature seen in a call.
 
-			params := []symbol.TypedIdent{}
+			n.Fun.ParamDecls = p.parseParams()
+			n.Fun.Type = p.parseType()
 
-			p.match(tokenTag('('))
-			for p.peek(0).tag != tokenTag(')') {
-				paramName, paramType := p.parseNameWithType()
-
-				params = append(params, symbol.TypedIdent{
-					Name: paramName,
-					Type: paramType,
-				})
-
-				paramId, paramAdded := p.t.Add(paramName, symbol.LVar)
-				if paramAdded {
-					sym := p.t.Get(paramId)
-					sym.Type = paramType
-					p.t.Set(paramId, sym)
-
-					n.Fun.Params = append(n.Fun.Params, paramId)
-				} else {
-					n.ReportHere(p.r, report.ReportNonfatal,
-						"duplicate parameter names")
+			for p.peek(0).tag == tokenTag('(') && p.peek(1).tag == tokenKeyword {
+				if !p.parseFunAttr(&n) {
+					break
 				}
 			}
-			p.match(tokenTag(')'))
-
-			funType := p.parseType()
 
 			if p.peek(0).tag == tokenTag(')') {
-				// Declaration
-				// * Exists -> Fail
-
 				n.Tag = ast.NodeFunDecl
-
-				if funAdded {
-					n.Id = funId
-
-					sym := p.t.Get(funId)
-					sym.Defined = false
-					sym.Type = funType
-					sym.Fun.Params = params
-					p.t.Set(funId, sym)
-				} else {
-					n.ReportHere(p.r, report.ReportNonfatal,
-						"function is already declared")
-				}
 			} else {
-				// Definition
-				// * Does not exist -> Add symbol with 'defined'
-				// * Exists, but not defined -> Grab symbol and set 'defined'
-				// * Exists and defined -> Fail
-
 				n.Tag = ast.NodeFunDef
 
-				decl := symbol.IdNone
-
-				if funAdded {
-					// Declaration didn't exist, adding definition
-					decl = funId
-
-					sym := p.t.Get(funId)
-					sym.Defined = true
-					sym.Type = funType
-					sym.Fun.Params = params
-					p.t.Set(funId, sym)
-				} else {
-					// Declaration existed, modifying it
-
-					id, exists := p.t.ResolveWithTag(funName, symbol.Fun)
-					if !exists {
-						panic("unreachable")
-					}
-					decl = id
-
-					sym := p.t.Get(id)
-
-					if sym.Defined {
-						n.ReportHere(p.r, report.ReportNonfatal,
-							"function is already defined")
-					} else {
-						// Checking if signatures match in 'checker'
-						sym.Defined = true
-						p.t.Set(id, sym)
-					}
-				}
-
-				n.Id = decl
 				p.state = inFunction
-				p.function = decl
 
 				for {
 					stmt := p.parseList()
@@ -299,8 +167,6 @@ func (p *Parser) parseList() *ast.Node {
 				p.state = inGlobal
 			}
 
-			p.t.PopScope()
-
 		case "return":
 			n.Tag = ast.NodeReturn
 
@@ -310,28 +176,42 @@ func (p *Parser) parseList() *ast.Node {
 			}
 
 			n.Return.Val = p.parseItem()
-			n.Return.Fun = p.function
+
+		case "tailcall":
+			call := p.parseList()
+			if call.Tag != ast.NodeFunCall {
+				call.ReportHere(p.r, report.ReportNonfatal,
+					"expected a function call")
+			}
+
+			line, column := n.Line, n.Column
+			n = *call
+			n.Line, n.Column = line, column
+			n.Fun.Tail = true
+
+		case "syscall":
+			n.Tag = ast.NodeSyscall
+
+			for p.peek(0).tag != tokenTag(')') {
+				n.Fun.Args = append(n.Fun.Args, p.parseItem())
+			}
 
 		case "if":
 			n.Tag = ast.NodeIf
 
 			n.If.Exp = p.parseItem()
 
-			p.t.PushScope()
 			for p.peek(0).tag == tokenTag('(') {
 				n.If.IfStmts = append(n.If.IfStmts, p.parseList())
 			}
-			p.t.PopScope()
 
 			{
 				t := p.peek(0)
 				if t.tag == tokenKeyword && t.data == "else" {
 					p.match(tokenKeyword)
-					p.t.PushScope()
 					for p.peek(0).tag == tokenTag('(') {
 						n.If.ElseStmts = append(n.If.ElseStmts, p.parseList())
 					}
-					p.t.PopScope()
 				}
 			}
 
@@ -344,50 +224,24 @@ func (p *Parser) parseList() *ast.Node {
 
 			n.While.Exp = p.parseItem()
 
-			p.t.PushScope()
 			for p.peek(0).tag == tokenTag('(') {
 				n.While.Stmts = append(n.While.Stmts, p.parseList())
 			}
-			p.t.PopScope()
 
 		case "for":
 			n.Tag = ast.NodeFor
 
-			p.t.PushScope()
 			n.For.Init = p.parseList()
 			n.For.Cond = p.parseItem()
 			n.For.Adv = p.parseList()
 			for p.peek(0).tag == tokenTag('(') {
 				n.For.Stmts = append(n.For.Stmts, p.parseList())
 			}
-			p.t.PopScope()
 
 		case "typedef":
 			n.Tag = ast.NodeTypedef
 
-			name, toDef := p.parseNameWithType()
-
-			id, added := p.t.Add(name, symbol.Type)
-
-			if added {
-				n.Id = id
-
-				toDefNode := types.Get(toDef)
-				defNode := types.TypeNode{
-					Tag:       types.Definition,
-					DefinedAs: toDef,
-					Size:      toDefNode.Size,
-					Align:     toDefNode.Align,
-				}
-				def := types.Register(defNode)
-
-				sym := p.t.Get(id)
-				sym.Type = def
-				p.t.Set(id, sym)
-			} else {
-				n.ReportHere(p.r, report.ReportNonfatal,
-					"type is already declared in the current scope")
-			}
+			n.Name, n.Typedef.DefinedAs = p.parseNameWithType()
 
 		default:
 			// TODO: Throw fatal on unrecognized keyword
@@ -395,32 +249,13 @@ func (p *Parser) parseList() *ast.Node {
 		}
 
 	case tokenIdent:
-		name := p.match(tokenIdent).data
-		id, exists := p.t.Resolve(name)
-
-		if exists {
-			sym := p.t.Get(id)
-
-			switch sym.Tag {
-			case symbol.Type:
-				n.Tag = ast.NodeCast
-				n.Cast.To = sym.Type
-				n.Cast.What = p.parseItem()
-
-			case symbol.Fun:
-				n.Tag = ast.NodeFunCall
-				n.Id = id
-				for p.peek(0).tag != tokenTag(')') {
-					n.Fun.Args = append(n.Fun.Args, p.parseItem())
-				}
+		// This is either a function call or a cast to a type
+		// defined with 'typedef', 'resolver' decides which one.
+		n.Tag = ast.NodeFunCall
+		n.Name = p.match(tokenIdent).data
 
-			default:
-				n.ReportHere(p.r, report.ReportNonfatal,
-					"unexpected identifier")
-			}
-		} else {
-			n.ReportHere(p.r, report.ReportNonfatal,
-				fmt.Sprintf("%s is not declared", name))
+		for p.peek(0).tag != tokenTag(')') {
+			n.Fun.Args = append(n.Fun.Args, p.parseItem())
 		}
 
 	case tokenType:
@@ -470,15 +305,7 @@ func (p *Parser) parseItem() *ast.Node {
 
 		// TODO: Add global variables
 		n.Tag = ast.NodeLVar
-
-		id, exists := p.t.ResolveWithTag(t.data, symbol.LVar)
-
-		if exists {
-			n.Id = id
-		} else {
-			n.ReportHere(p.r, report.ReportNonfatal,
-				"local variable does not exist")
-		}
+		n.Name = t.data
 
 	case tokenKeyword:
 		switch p.consume().data {
@@ -568,25 +395,9 @@ func (p *Parser) parseBinOp(n *ast.Node) {
 
 func (p *Parser) parseType() types.Id {
 	if p.peek(0).tag == tokenIdent {
-		t := p.match(tokenIdent)
-
-		name := t.data
-
-		id, exists := p.t.ResolveWithTag(name, symbol.Type)
-
-		if exists {
-			sym := p.t.Get(id)
-			return sym.Type
-		} else {
-			p.r.Report(report.Form{
-				Tag:    report.ReportNonfatal,
-				Line:   t.line,
-				Column: t.column,
-				Msg:    fmt.Sprintf("type '%s' does not exist in the current scope", name),
-			})
-			// TODO: Returning IdNone looks scary
-			return types.IdNone
-		}
+		// Resolved in 'resolver'
+		name := p.match(tokenIdent).data
+		return types.Register(types.TypeNode{Tag: types.Named, Name: name})
 	}
 
 	t := p.match(tokenType)
@@ -624,6 +435,50 @@ func (p *Parser) parseType() types.Id {
 	}
 }
 
+// Attributes are lists with a single keyword after the return
+// type. Returns false if the next list is not an attribute.
+func (p *Parser) parseFunAttr(n *ast.Node) bool {
+	switch p.peek(1).data {
+	case "inline":
+		n.Fun.Inline = true
+
+	case "noinline":
+		n.Fun.NoInline = true
+
+	case "export":
+		n.Fun.Export = true
+
+	default:
+		return false
+	}
+
+	p.match(tokenTag('('))
+	p.match(tokenKeyword)
+	p.match(tokenTag(')'))
+
+	return true
+}
+
+func (p *Parser) parseParams() []*ast.Node {
+	params := []*ast.Node{}
+
+	p.match(tokenTag('('))
+	for p.peek(0).tag != tokenTag(')') {
+		ident := p.peek(0)
+		param := ast.Node{
+			Tag:    ast.NodeLVarDecl,
+			Id:     symbol.IdNone,
+			Line:   ident.line,
+			Column: ident.column,
+		}
+		param.Name, param.LVarDecl.Type = p.parseNameWithType()
+		params = append(params, &param)
+	}
+	p.match(tokenTag(')'))
+
+	return params
+}
+
 func (p *Parser) parseNameWithType() (string, types.Id) {
 	name := p.match(tokenIdent).data
 	p.match(tokenTag(':'))
@@ -21,15 +21,21 @@ type Form struct {
 
 type ReportTag uint
 
+// Fatal errors unwind the compiler as a panic with this value, the
+// error is already reported when it is recovered
+type Fatal struct{}
+
 const (
 	reportError ReportTag = iota
 	ReportFatal
 	ReportNonfatal
+	ReportWarning
 )
 
 func (r *Reporter) Report(f Form) {
-	// TODO: Dont increment this on warnings (when they are added)
-	r.errorCount += 1
+	if f.Tag != ReportWarning {
+		r.errorCount += 1
+	}
 
 	if f.Line == 0 || f.Column == 0 {
 		panic("line or column not set in report")
@@ -37,12 +43,16 @@ func (r *Reporter) Report(f Form) {
 
 	switch f.Tag {
 	case ReportFatal:
-		fmt.Printf("%s:%d:%d: fatal: %s\n",
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: fatal: %s\n",
 			r.FileName, f.Line, f.Column, f.Msg)
-		os.Exit(1)
+		panic(Fatal{})
 
 	case ReportNonfatal:
-		fmt.Printf("%s:%d:%d: error: %s\n",
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: error: %s\n",
+			r.FileName, f.Line, f.Column, f.Msg)
+
+	case ReportWarning:
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: warning: %s\n",
 			r.FileName, f.Line, f.Column, f.Msg)
 
 	default:
@@ -50,6 +60,10 @@ func (r *Reporter) Report(f Form) {
 	}
 }
 
+func (r *Reporter) HasErrors() bool {
+	return r.errorCount > 0
+}
+
 func (r *Reporter) ExitOnErrors(code int) {
 	if r.errorCount > 0 {
 		os.Exit(code)
@@ -0,0 +1,157 @@
+// This file contains the resolution of type and function
+// declarations.
+
+package resolver
+
+import (
+	"clic/ast"
+	"clic/symbol"
+	"clic/types"
+	"fmt"
+)
+
+// Replaces type names with the types they refer to. Reports at the
+// position of n, since types do not keep their own position.
+func (res *resolver) resolveType(id types.Id, n *ast.Node) types.Id {
+	if id == types.IdNone {
+		return id
+	}
+
+	node := types.Get(id)
+
+	switch node.Tag {
+	case types.Named:
+		symId, exists := res.t.ResolveWithTag(node.Name, symbol.Type)
+		if !exists {
+			res.report(n, fmt.Sprintf("type '%s' does not exist in the current scope",
+				node.Name))
+			return types.IdNone
+		}
+		return res.t.Get(symId).Type
+
+	case types.Struct:
+		for i, field := range node.Fields {
+			node.Fields[i].Type = res.resolveType(field.Type, n)
+		}
+		types.Set(id, node)
+	}
+
+	return id
+}
+
+func (res *resolver) declareType(n *ast.Node) {
+	id, added := res.t.Add(n.Name, symbol.Type, n.Line, n.Column)
+
+	if added {
+		n.Id = id
+
+		// Resolved and sized later, the type can refer to a
+		// type declared after it.
+		def := types.Register(types.TypeNode{
+			Tag:       types.Definition,
+			DefinedAs: n.Typedef.DefinedAs,
+		})
+
+		sym := res.t.Get(id)
+		sym.Type = def
+		res.t.Set(id, sym)
+	} else {
+		res.report(n, "type is already declared in the current scope")
+	}
+}
+
+func (res *resolver) defineType(n *ast.Node) {
+	if n.Id == symbol.IdNone {
+		return
+	}
+
+	def := res.t.Get(n.Id).Type
+	defNode := types.Get(def)
+	defNode.DefinedAs = res.resolveType(defNode.DefinedAs, n)
+	types.Set(def, defNode)
+}
+
+func (res *resolver) sizeType(n *ast.Node) {
+	if n.Id == symbol.IdNone {
+		return
+	}
+
+	def := res.t.Get(n.Id).Type
+
+	// Walking the definitions by hand, types.Underlying()
+	// would not stop on a cycle.
+	seen := map[types.Id]bool{}
+	id := def
+	for types.Get(id).Tag == types.Definition {
+		if seen[id] {
+			res.report(n, fmt.Sprintf("type '%s' is defined in terms of itself", n.Name))
+			return
+		}
+		seen[id] = true
+
+		id = types.Get(id).DefinedAs
+		if id == types.IdNone {
+			// Error is already reported
+			return
+		}
+	}
+
+	defNode := types.Get(def)
+	defNode.Size = types.Get(id).Size
+	defNode.Align = types.Get(id).Align
+	types.Set(def, defNode)
+}
+
+// A function can be declared once and defined once, in any order.
+func (res *resolver) declareFun(n *ast.Node) {
+	params := []symbol.TypedIdent{}
+	names := map[string]bool{}
+
+	for _, param := range n.Fun.ParamDecls {
+		param.LVarDecl.Type = res.resolveType(param.LVarDecl.Type, param)
+
+		if names[param.Name] {
+			res.report(n, "duplicate parameter names")
+		}
+		names[param.Name] = true
+
+		params = append(params, symbol.TypedIdent{
+			Name: param.Name,
+			Type: param.LVarDecl.Type,
+		})
+	}
+
+	n.Fun.Type = res.resolveType(n.Fun.Type, n)
+
+	id, added := res.t.Add(n.Name, symbol.Fun, n.Line, n.Column)
+
+	if added {
+		n.Id = id
+
+		sym := res.t.Get(id)
+		sym.Defined = (n.Tag == ast.NodeFunDef)
+		sym.Type = n.Fun.Type
+		sym.Fun.Params = params
+		res.t.Set(id, sym)
+		return
+	}
+
+	id, exists := res.t.ResolveWithTag(n.Name, symbol.Fun)
+	if !exists {
+		res.report(n, fmt.Sprintf("%s is already declared", n.Name))
+		return
+	}
+
+	sym := res.t.Get(id)
+
+	if n.Tag != ast.NodeFunDef {
+		res.report(n, "function is already declared")
+	} else if sym.Defined {
+		res.report(n, "function is already defined")
+	} else {
+		// Checking if signatures match in 'checker'
+		n.Id = id
+		sym.Defined = true
+		res.t.Set(id, sym)
+	}
+}
@@ -0,0 +1,276 @@
+// This file contains the name resolution pass. It runs between the
+// parser and the checker and fills symbol ids, types of 'auto'
+// variables and the symbol table itself.
+//
+// Top-level types and functions are declared before any function
+// body is resolved, so they can be used before their definition.
+
+package resolver
+
+import (
+	"clic/ast"
+	"clic/report"
+	"clic/symbol"
+	"clic/types"
+	"fmt"
+)
+
+type resolver struct {
+	t *symbol.Table
+	r *report.Reporter
+
+	errorCount uint
+	function   symbol.Id
+}
+
+func Resolve(roots []*ast.Node, t *symbol.Table, r *report.Reporter) {
+	res := resolver{
+		t:        t,
+		r:        r,
+		function: symbol.IdNone,
+	}
+
+	t.PushScope()
+
+	// Types first, since function signatures refer to them
+	for _, node := range roots {
+		if node.Tag == ast.NodeTypedef {
+			res.declareType(node)
+		}
+	}
+	for _, node := range roots {
+		if node.Tag == ast.NodeTypedef {
+			res.defineType(node)
+		}
+	}
+	for _, node := range roots {
+		if node.Tag == ast.NodeTypedef {
+			res.sizeType(node)
+		}
+	}
+
+	// Declarations before definitions, so the symbol keeps the
+	// signature of the declaration and 'checker' can compare the
+	// definition against it.
+	for _, node := range roots {
+		if node.Tag == ast.NodeFunEx || node.Tag == ast.NodeFunDecl {
+			res.declareFun(node)
+		}
+	}
+	for _, node := range roots {
+		if node.Tag == ast.NodeFunDef {
+			res.declareFun(node)
+		}
+	}
+
+	for _, node := range roots {
+		switch node.Tag {
+		case ast.NodeTypedef:
+		case ast.NodeFunEx:
+		case ast.NodeFunDecl:
+
+		default:
+			res.resolveNode(node)
+		}
+	}
+
+	t.PopScope()
+}
+
+func (res *resolver) report(n *ast.Node, msg string) {
+	res.errorCount += 1
+	n.ReportHere(res.r, report.ReportNonfatal, msg)
+}
+
+func (res *resolver) resolveNode(n *ast.Node) {
+	if n == nil {
+		return
+	}
+
+	switch n.Tag {
+	case ast.NodeScope:
+		res.t.PushScope()
+		res.resolveStmts(n.Scope.Stmts)
+		res.t.PopScope()
+
+	case ast.NodeLVarDecl:
+		typ := res.resolveType(n.LVarDecl.Type, n)
+		res.declareLVar(n, typ)
+
+	case ast.NodeLVar:
+		id, exists := res.t.ResolveWithTag(n.Name, symbol.LVar)
+		if exists {
+			n.Id = id
+		} else {
+			res.report(n, fmt.Sprintf("local variable '%s' does not exist", n.Name))
+		}
+
+	case ast.NodeBinOp:
+		lval := n.BinOp.Lval
+		isAuto := (n.BinOp.Tag == ast.BinOpAssign) &&
+			(lval.Tag == ast.NodeLVarDecl) &&
+			(lval.LVarDecl.Type == types.IdNone)
+
+		if isAuto {
+			// The variable is not visible in its own
+			// initializer.
+			errorCount := res.errorCount
+			res.resolveNode(n.BinOp.Rval)
+
+			typ := types.IdNone
+			if res.errorCount == errorCount {
+				typ = n.BinOp.Rval.GetTypeShallow(res.t)
+			}
+			res.declareLVar(lval, typ)
+		} else {
+			res.resolveNode(n.BinOp.Lval)
+			res.resolveNode(n.BinOp.Rval)
+		}
+
+	case ast.NodeFunCall:
+		id, exists := res.t.Resolve(n.Name)
+		if !exists {
+			res.report(n, fmt.Sprintf("%s is not declared", n.Name))
+			break
+		}
+
+		switch res.t.Get(id).Tag {
+		case symbol.Type:
+			if n.Fun.Tail {
+				res.report(n, "only function calls can be tail calls")
+				break
+			}
+			if len(n.Fun.Args) != 1 {
+				res.report(n, fmt.Sprintf("expected 1 value to cast, got %d",
+					len(n.Fun.Args)))
+				break
+			}
+
+			n.Tag = ast.NodeCast
+			n.Cast.To = res.t.Get(id).Type
+			n.Cast.What = n.Fun.Args[0]
+			n.Fun.Args = nil
+			res.resolveNode(n.Cast.What)
+
+		case symbol.Fun:
+			n.Id = id
+			for _, arg := range n.Fun.Args {
+				res.resolveNode(arg)
+			}
+
+		default:
+			res.report(n, "unexpected identifier")
+		}
+
+	case ast.NodeCast:
+		n.Cast.To = res.resolveType(n.Cast.To, n)
+		res.resolveNode(n.Cast.What)
+
+	case ast.NodeSyscall:
+		for _, arg := range n.Fun.Args {
+			res.resolveNode(arg)
+		}
+
+	case ast.NodeReturn:
+		n.Return.Fun = res.function
+		res.resolveNode(n.Return.Val)
+
+	case ast.NodeIf:
+		res.resolveNode(n.If.Exp)
+
+		res.t.PushScope()
+		res.resolveStmts(n.If.IfStmts)
+		res.t.PopScope()
+
+		res.t.PushScope()
+		res.resolveStmts(n.If.ElseStmts)
+		res.t.PopScope()
+
+	case ast.NodeWhile:
+		res.resolveNode(n.While.Exp)
+
+		res.t.PushScope()
+		res.resolveStmts(n.While.Stmts)
+		res.t.PopScope()
+
+	case ast.NodeFor:
+		res.t.PushScope()
+		res.resolveNode(n.For.Init)
+		res.resolveNode(n.For.Cond)
+		res.resolveNode(n.For.Adv)
+		res.resolveStmts(n.For.Stmts)
+		res.t.PopScope()
+
+	case ast.NodeFunDef:
+		res.resolveFunction(n)
+
+	// Declarations inside of functions are only visible after
+	// they appear.
+	case ast.NodeTypedef:
+		res.declareType(n)
+		res.defineType(n)
+		res.sizeType(n)
+
+	case ast.NodeFunEx:
+		res.declareFun(n)
+
+	case ast.NodeFunDecl:
+		res.declareFun(n)
+
+	// Do nothing
+	case ast.NodeInt:
+	case ast.NodeBool:
+	case ast.NodeEmpty:
+
+	default:
+		panic("not implemented")
+	}
+}
+
+func (res *resolver) resolveStmts(stmts []*ast.Node) {
+	for _, stmt := range stmts {
+		res.resolveNode(stmt)
+	}
+}
+
+func (res *resolver) declareLVar(n *ast.Node, typ types.Id) {
+	id, added := res.t.Add(n.Name, symbol.LVar, n.Line, n.Column)
+
+	if added {
+		n.Id = id
+		sym := res.t.Get(id)
+		sym.Type = typ
+		res.t.Set(id, sym)
+	} else {
+		res.report(n, "local variable is already declared in the current scope")
+	}
+}
+
+// Adds parameters as local variables, so they can be seen in the
+// scope. Keeping their ids so codegen can assign offsets.
+func (res *resolver) resolveFunction(n *ast.Node) {
+	if n.Id == symbol.IdNone {
+		// Declaration failed, the error is already reported
+		return
+	}
+
+	res.t.PushScope()
+
+	for _, param := range n.Fun.ParamDecls {
+		id, added := res.t.Add(param.Name, symbol.LVar, param.Line, param.Column)
+		if added {
+			param.Id = id
+			sym := res.t.Get(id)
+			sym.Type = param.LVarDecl.Type
+			res.t.Set(id, sym)
+
+			n.Fun.Params = append(n.Fun.Params, id)
+		}
+	}
+
+	res.function = n.Id
+	res.resolveStmts(n.Fun.Stmts)
+	res.function = symbol.IdNone
+
+	res.t.PopScope()
+}
@@ -24,7 +24,12 @@ type symbol struct {
 	Name string
 	Type types.Id
 
+	// Position of the declaration
+	Line   uint
+	Column uint
+
 	Defined bool // For functions and types
+	Used    bool // Set in 'checker' when the symbol is read or called
 
 	LVar struct {
 		Offset uint
@@ -56,7 +61,7 @@ func (t *Table) PopScope() {
 	t.scopeStack = t.scopeStack[:len(t.scopeStack)-1]
 }
 
-func (t *Table) Add(name string, tag tag) (Id, bool) {
+func (t *Table) Add(name string, tag tag, line uint, column uint) (Id, bool) {
 	if len(t.scopeStack) == 0 {
 		panic("adding symbol with no scopes")
 	}
@@ -69,6 +74,8 @@ func (t *Table) Add(name string, tag tag) (Id, bool) {
 	sym := symbol{
 		Name:    name,
 		Tag:     tag,
+		Line:    line,
+		Column:  column,
 		Defined: false,
 	}
 	id := Id(len(t.data))
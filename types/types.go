@@ -18,6 +18,9 @@ type TypeNode struct {
 
 	// Struct & union
 	Fields []Field
+
+	// Type referenced by name
+	Name string
 }
 
 type Field struct {
@@ -41,6 +44,10 @@ const (
 
 	// Compound types
 	Struct
+
+	// Type name that is not resolved yet. The parser registers
+	// these, 'resolver' replaces them with the named type.
+	Named
 )
 
 var table = []TypeNode{}
@@ -79,6 +86,10 @@ func Get(id Id) TypeNode {
 	return table[id]
 }
 
+func Set(id Id, node TypeNode) {
+	table[id] = node
+}
+
 func GetBuiltin(tag tag) Id {
 	id, ok := builtin[tag]
 	if !ok {
@@ -89,6 +100,16 @@ func GetBuiltin(tag tag) Id {
 	return id
 }
 
+// Recurses through type defenitions to get the actual type
+func (id Id) Underlying() Id {
+	node := table[id]
+	for node.Tag == Definition {
+		id = node.DefinedAs
+		node = table[id]
+	}
+	return id
+}
+
 func (id Id) Stringify() string {
 	// Should not break on builtin types. We register the type
 	// when we get an id.
@@ -118,6 +139,9 @@ func (id Id) Stringify() string {
 	case Definition:
 		return "type, defined as " + node.DefinedAs.Stringify()
 
+	case Named:
+		return node.Name
+
 	default:
 		panic("not implemented")
 	}
@@ -0,0 +1,77 @@
+// This file contains the bytecode of the virtual machine. Every
+// value on the stack is a uint64, signed integers are two's
+// complement and bools are 0 or 1.
+
+package vm
+
+type op byte
+
+const (
+	opError op = iota
+
+	opConst // imm: i64
+	opLoad  // imm: u16 local
+	opStore // imm: u16 local, pops the value
+	opDup
+	opDrop
+
+	opAdd
+	opSub
+	opMul
+	opSDiv
+	opUDiv
+	opSRem
+	opURem
+
+	opEq
+	opNe
+	opSLt
+	opSLe
+	opSGt
+	opSGe
+	opULt
+	opULe
+	opUGt
+	opUGe
+
+	opToBool // Integer to bool, non-zero is true
+
+	opJump      // imm: u32 offset in the code
+	opJumpIfNot // imm: u32 offset in the code, pops the condition
+
+	opCall     // imm: u16 function
+	opCallEx   // imm: u16 external function
+	opTailCall // imm: u16 function, reuses the frame of the caller
+	opRet      // Returns the top of the stack if the function has a result
+)
+
+// Size of the immediate of each instruction, in bytes
+var immSizes = [256]int{
+	opConst:     8,
+	opLoad:      2,
+	opStore:     2,
+	opJump:      4,
+	opJumpIfNot: 4,
+	opCall:      2,
+	opCallEx:    2,
+	opTailCall:  2,
+}
+
+type Function struct {
+	Name   string
+	Params int
+	Locals int // Including the parameters
+	Ret    bool
+	Code   []byte
+}
+
+type Extern struct {
+	Name   string
+	Params int
+	Ret    bool
+}
+
+type Program struct {
+	Funcs   []Function
+	Externs []Extern
+}
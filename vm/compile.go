@@ -0,0 +1,347 @@
+// This file contains the compiler from the checked AST to the
+// bytecode.
+
+package vm
+
+import (
+	"clic/ast"
+	"clic/symbol"
+	"clic/types"
+	"encoding/binary"
+	"fmt"
+)
+
+type compiler struct {
+	t *symbol.Table
+
+	funcs   map[symbol.Id]uint16
+	externs map[symbol.Id]uint16
+
+	fun    *Function
+	locals map[symbol.Id]uint16
+
+	// Every call in tail position becomes a tail call, not only
+	// the ones written with 'tailcall', see 'opt.PassTailCall'
+	tailCalls bool
+
+	// First construct the VM can't run
+	err error
+}
+
+func Compile(roots []*ast.Node, t *symbol.Table, tailCalls bool) (*Program, error) {
+	p := &Program{}
+	c := compiler{
+		t:         t,
+		funcs:     make(map[symbol.Id]uint16),
+		externs:   make(map[symbol.Id]uint16),
+		tailCalls: tailCalls,
+	}
+
+	// Functions can be called before they are defined
+	defined := map[string]uint16{}
+	for _, node := range roots {
+		if node.Tag == ast.NodeFunDef {
+			sym := t.Get(node.Id)
+			c.funcs[node.Id] = uint16(len(p.Funcs))
+			defined[sym.Name] = c.funcs[node.Id]
+			p.Funcs = append(p.Funcs, Function{
+				Name:   sym.Name,
+				Params: len(sym.Fun.Params),
+				Ret:    hasResult(sym.Type),
+			})
+		}
+	}
+
+	// Declarations inside of functions have their own symbols,
+	// every declaration of a name is the same function
+	declared := map[string]uint16{}
+	for _, root := range roots {
+		ast.Walk(root, func(n *ast.Node) {
+			if n.Tag != ast.NodeFunEx && n.Tag != ast.NodeFunDecl {
+				return
+			}
+			sym := t.Get(n.Id)
+
+			if n.Tag == ast.NodeFunDecl {
+				if index, ok := defined[sym.Name]; ok {
+					c.funcs[n.Id] = index
+				}
+				return
+			}
+
+			index, ok := declared[sym.Name]
+			if !ok {
+				index = uint16(len(p.Externs))
+				declared[sym.Name] = index
+				p.Externs = append(p.Externs, Extern{
+					Name:   sym.Name,
+					Params: len(sym.Fun.Params),
+					Ret:    hasResult(sym.Type),
+				})
+			}
+			c.externs[n.Id] = index
+		})
+	}
+
+	for _, node := range roots {
+		if node.Tag == ast.NodeFunDef {
+			c.compileFunction(node, &p.Funcs[c.funcs[node.Id]])
+		}
+	}
+
+	return p, c.err
+}
+
+// Keeps the first error, the program is not run anyway
+func (c *compiler) fail(n *ast.Node, format string, args ...any) {
+	if c.err == nil {
+		pos := fmt.Sprintf("%d:%d: ", n.Line, n.Column)
+		c.err = fmt.Errorf(pos+format, args...)
+	}
+}
+
+func hasResult(id types.Id) bool {
+	return id.Underlying() != types.GetBuiltin(types.Void)
+}
+
+func isUnsigned(id types.Id) bool {
+	return id.Underlying() == types.GetBuiltin(types.U64)
+}
+
+// Writes the instruction and returns the position of its immediate
+func (c *compiler) emit(o op, imm uint64) int {
+	c.fun.Code = append(c.fun.Code, byte(o))
+	pos := len(c.fun.Code)
+	for i := 0; i < immSizes[o]; i++ {
+		c.fun.Code = append(c.fun.Code, byte(imm>>(8*i)))
+	}
+	return pos
+}
+
+// Points a jump emitted earlier at the current position
+func (c *compiler) patch(pos int) {
+	binary.LittleEndian.PutUint32(c.fun.Code[pos:], uint32(len(c.fun.Code)))
+}
+
+func (c *compiler) local(id symbol.Id) uint64 {
+	index, ok := c.locals[id]
+	if !ok {
+		index = uint16(len(c.locals))
+		c.locals[id] = index
+	}
+	return uint64(index)
+}
+
+func (c *compiler) compileFunction(n *ast.Node, f *Function) {
+	c.fun = f
+	c.locals = make(map[symbol.Id]uint16)
+
+	// Parameters are the first locals, the caller pushes them
+	for _, param := range n.Fun.Params {
+		c.local(param)
+	}
+
+	c.compileStmts(n.Fun.Stmts)
+
+	// Only reachable in void functions, 'checker' makes sure
+	// the others return on every path.
+	stmts := n.Fun.Stmts
+	if len(stmts) == 0 || stmts[len(stmts)-1].Tag != ast.NodeReturn {
+		c.emit(opRet, 0)
+	}
+
+	f.Locals = len(c.locals)
+}
+
+func (c *compiler) compileStmts(stmts []*ast.Node) {
+	for _, stmt := range stmts {
+		c.compileStmt(stmt)
+	}
+}
+
+func (c *compiler) compileStmt(n *ast.Node) {
+	switch n.Tag {
+	// Calls find the functions declared inside of functions in
+	// 'Compile', and types don't matter to the VM
+	case ast.NodeEmpty, ast.NodeTypedef, ast.NodeFunEx, ast.NodeFunDecl:
+
+	// Locals start zeroed, the slot is taken on first use
+	case ast.NodeLVarDecl:
+		c.local(n.Id)
+
+	case ast.NodeScope:
+		c.compileStmts(n.Scope.Stmts)
+
+	case ast.NodeReturn:
+		val := n.Return.Val
+		if val.Tag == ast.NodeFunCall && (val.Fun.Tail || c.tailCalls) {
+			if index, ok := c.funcs[val.Id]; ok {
+				c.compileArgs(val)
+				c.emit(opTailCall, uint64(index))
+				break
+			}
+		}
+		if val.Tag != ast.NodeEmpty {
+			c.compileExpr(val)
+		}
+		c.emit(opRet, 0)
+
+	case ast.NodeIf:
+		c.compileExpr(n.If.Exp)
+		toElse := c.emit(opJumpIfNot, 0)
+		c.compileStmts(n.If.IfStmts)
+
+		if len(n.If.ElseStmts) == 0 {
+			c.patch(toElse)
+			break
+		}
+
+		toEnd := c.emit(opJump, 0)
+		c.patch(toElse)
+		c.compileStmts(n.If.ElseStmts)
+		c.patch(toEnd)
+
+	case ast.NodeWhile:
+		c.compileLoop(n.While.Exp, n.While.Stmts, nil)
+
+	case ast.NodeFor:
+		c.compileStmt(n.For.Init)
+		c.compileLoop(n.For.Cond, n.For.Stmts, n.For.Adv)
+
+	case ast.NodeBinOp:
+		if n.BinOp.Tag == ast.BinOpAssign {
+			c.compileExpr(n.BinOp.Rval)
+			c.emit(opStore, c.local(n.BinOp.Lval.Id))
+			break
+		}
+		c.compileExprStmt(n)
+
+	default:
+		c.compileExprStmt(n)
+	}
+}
+
+func (c *compiler) compileLoop(cond *ast.Node, stmts []*ast.Node, adv *ast.Node) {
+	start := len(c.fun.Code)
+	c.compileExpr(cond)
+	toEnd := c.emit(opJumpIfNot, 0)
+
+	c.compileStmts(stmts)
+	if adv != nil {
+		c.compileStmt(adv)
+	}
+	c.emit(opJump, uint64(start))
+
+	c.patch(toEnd)
+}
+
+func (c *compiler) compileExprStmt(n *ast.Node) {
+	c.compileExpr(n)
+	if hasResult(n.GetTypeShallow(c.t)) {
+		c.emit(opDrop, 0)
+	}
+}
+
+func (c *compiler) compileArgs(n *ast.Node) {
+	for _, arg := range n.Fun.Args {
+		c.compileExpr(arg)
+	}
+}
+
+// Operands are pushed left to right, which is the evaluation order
+// of CLI.
+func (c *compiler) compileExpr(n *ast.Node) {
+	switch n.Tag {
+	case ast.NodeInt:
+		imm := uint64(n.Int.SValue)
+		if !n.Int.Signed {
+			imm = n.Int.UValue
+		}
+		c.emit(opConst, imm)
+
+	case ast.NodeBool:
+		imm := uint64(0)
+		if n.Bool.Value {
+			imm = 1
+		}
+		c.emit(opConst, imm)
+
+	case ast.NodeLVar:
+		c.emit(opLoad, c.local(n.Id))
+
+	case ast.NodeFunCall:
+		c.compileArgs(n)
+		if index, ok := c.externs[n.Id]; ok {
+			c.emit(opCallEx, uint64(index))
+		} else if index, ok := c.funcs[n.Id]; ok {
+			c.emit(opCall, uint64(index))
+		} else {
+			c.fail(n, "function '%s' is declared but never defined", c.t.Get(n.Id).Name)
+		}
+
+	// System calls need real memory and the numbers depend on
+	// the target, like in the interpreter
+	case ast.NodeSyscall:
+		c.fail(n, "syscall is not supported by the VM")
+
+	// Integer types share their representation and bools are
+	// already 0 or 1, so only conversions to bool do something.
+	case ast.NodeCast:
+		c.compileExpr(n.Cast.What)
+		from := n.Cast.What.GetTypeDeep(c.t)
+		to := n.Cast.To.Underlying()
+		if to == types.GetBuiltin(types.Bool) && from != to {
+			c.emit(opToBool, 0)
+		}
+
+	case ast.NodeBinOp:
+		c.compileBinOp(n)
+
+	default:
+		panic("not implemented")
+	}
+}
+
+var arithOps = map[ast.BinOpArithTag][2]op{
+	ast.BinOpSum:  {opAdd, opAdd},
+	ast.BinOpSub:  {opSub, opSub},
+	ast.BinOpMult: {opMul, opMul},
+	ast.BinOpDiv:  {opSDiv, opUDiv},
+	ast.BinOpMod:  {opSRem, opURem},
+}
+
+var compOps = map[ast.BinOpCompTag][2]op{
+	ast.BinOpEq:      {opEq, opEq},
+	ast.BinOpNeq:     {opNe, opNe},
+	ast.BinOpLessEq:  {opSLe, opULe},
+	ast.BinOpLess:    {opSLt, opULt},
+	ast.BinOpGreatEq: {opSGe, opUGe},
+	ast.BinOpGreat:   {opSGt, opUGt},
+}
+
+func (c *compiler) compileBinOp(n *ast.Node) {
+	if n.BinOp.Tag == ast.BinOpAssign {
+		c.compileExpr(n.BinOp.Rval)
+		c.emit(opDup, 0)
+		c.emit(opStore, c.local(n.BinOp.Lval.Id))
+		return
+	}
+
+	c.compileExpr(n.BinOp.Lval)
+	c.compileExpr(n.BinOp.Rval)
+
+	// Signed variant first
+	variant := 0
+	if isUnsigned(n.BinOp.Lval.GetTypeShallow(c.t)) {
+		variant = 1
+	}
+
+	switch n.BinOp.Tag {
+	case ast.BinOpArith:
+		c.emit(arithOps[n.BinOp.ArithTag][variant], 0)
+	case ast.BinOpComp:
+		c.emit(compOps[n.BinOp.CompTag][variant], 0)
+	default:
+		panic("not implemented")
+	}
+}
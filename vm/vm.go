@@ -0,0 +1,242 @@
+// This file contains the interpreter of the bytecode. A host program
+// embeds CLI by compiling it, registering Go functions for the
+// 'exfun' declarations and calling into it.
+
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Go implementation of an 'exfun'. Arguments and the result use the
+// representation of the stack, the result is ignored for functions
+// returning void.
+type HostFunc func(args []uint64) uint64
+
+type frame struct {
+	fn   *Function
+	pc   int
+	base int // Position of the first local on the stack
+}
+
+// Deep enough for any sane recursion, small enough for the Go stack
+// of the interpreter, which has the same limit.
+const MaxFrames = 1 << 18
+
+type Machine struct {
+	p     *Program
+	hosts []HostFunc
+
+	stack  []uint64
+	frames []frame
+}
+
+func New(p *Program) *Machine {
+	return &Machine{
+		p:     p,
+		hosts: make([]HostFunc, len(p.Externs)),
+	}
+}
+
+// Functions the program does not declare are ignored, so a host can
+// register the same set for every program.
+func (m *Machine) Register(name string, f HostFunc) {
+	for i, ext := range m.p.Externs {
+		if ext.Name == name {
+			m.hosts[i] = f
+		}
+	}
+}
+
+// Runs a function of the program to completion. The result is 0
+// for functions returning void.
+func (m *Machine) Call(name string, args ...uint64) (uint64, error) {
+	for i := range m.p.Funcs {
+		fn := &m.p.Funcs[i]
+		if fn.Name != name {
+			continue
+		}
+		if len(args) != fn.Params {
+			return 0, fmt.Errorf("function '%s' expects %d arguments, got %d", name, fn.Params, len(args))
+		}
+
+		m.stack = append(m.stack[:0], args...)
+		m.frames = m.frames[:0]
+		return m.run(fn)
+	}
+
+	return 0, fmt.Errorf("function '%s' is not defined", name)
+}
+
+func (m *Machine) push(v uint64) {
+	m.stack = append(m.stack, v)
+}
+
+func (m *Machine) pop() uint64 {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
+}
+
+// Arguments are already on the stack, the rest of the locals start
+// zeroed
+func (m *Machine) enter(fn *Function, base int) frame {
+	for len(m.stack) < base+fn.Locals {
+		m.push(0)
+	}
+	return frame{fn: fn, base: base}
+}
+
+func boolValue(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (m *Machine) run(fn *Function) (uint64, error) {
+	fr := m.enter(fn, 0)
+
+	for {
+		code := fr.fn.Code
+		o := op(code[fr.pc])
+		imm := code[fr.pc+1:]
+		fr.pc += 1 + immSizes[o]
+
+		switch o {
+		case opConst:
+			m.push(binary.LittleEndian.Uint64(imm))
+
+		case opLoad:
+			m.push(m.stack[fr.base+int(binary.LittleEndian.Uint16(imm))])
+
+		case opStore:
+			m.stack[fr.base+int(binary.LittleEndian.Uint16(imm))] = m.pop()
+
+		case opDup:
+			m.push(m.stack[len(m.stack)-1])
+
+		case opDrop:
+			m.pop()
+
+		case opAdd, opSub, opMul, opSDiv, opUDiv, opSRem, opURem:
+			r := m.pop()
+			l := m.pop()
+
+			if r == 0 && o != opAdd && o != opSub && o != opMul {
+				return 0, fmt.Errorf("division by zero in '%s'", fr.fn.Name)
+			}
+
+			switch o {
+			case opAdd:
+				m.push(l + r)
+			case opSub:
+				m.push(l - r)
+			case opMul:
+				m.push(l * r)
+			case opSDiv:
+				m.push(uint64(int64(l) / int64(r)))
+			case opUDiv:
+				m.push(l / r)
+			case opSRem:
+				m.push(uint64(int64(l) % int64(r)))
+			case opURem:
+				m.push(l % r)
+			}
+
+		case opEq, opNe, opSLt, opSLe, opSGt, opSGe, opULt, opULe, opUGt, opUGe:
+			r := m.pop()
+			l := m.pop()
+
+			var res bool
+			switch o {
+			case opEq:
+				res = l == r
+			case opNe:
+				res = l != r
+			case opSLt:
+				res = int64(l) < int64(r)
+			case opSLe:
+				res = int64(l) <= int64(r)
+			case opSGt:
+				res = int64(l) > int64(r)
+			case opSGe:
+				res = int64(l) >= int64(r)
+			case opULt:
+				res = l < r
+			case opULe:
+				res = l <= r
+			case opUGt:
+				res = l > r
+			case opUGe:
+				res = l >= r
+			}
+			m.push(boolValue(res))
+
+		case opToBool:
+			m.push(boolValue(m.pop() != 0))
+
+		case opJump:
+			fr.pc = int(binary.LittleEndian.Uint32(imm))
+
+		case opJumpIfNot:
+			if m.pop() == 0 {
+				fr.pc = int(binary.LittleEndian.Uint32(imm))
+			}
+
+		case opCall:
+			// The current frame is not in 'frames'
+			callee := &m.p.Funcs[binary.LittleEndian.Uint16(imm)]
+			if len(m.frames)+1 == MaxFrames {
+				return 0, fmt.Errorf("stack overflow in '%s'", callee.Name)
+			}
+			m.frames = append(m.frames, fr)
+			fr = m.enter(callee, len(m.stack)-callee.Params)
+
+		case opCallEx:
+			index := binary.LittleEndian.Uint16(imm)
+			ext := m.p.Externs[index]
+			if m.hosts[index] == nil {
+				return 0, fmt.Errorf("exfun '%s' is not registered", ext.Name)
+			}
+
+			// The host may keep the slice
+			base := len(m.stack) - ext.Params
+			args := append([]uint64{}, m.stack[base:]...)
+			m.stack = m.stack[:base]
+
+			res := m.hosts[index](args)
+			if ext.Ret {
+				m.push(res)
+			}
+
+		// Arguments replace the locals of the caller
+		case opTailCall:
+			callee := &m.p.Funcs[binary.LittleEndian.Uint16(imm)]
+			args := m.stack[len(m.stack)-callee.Params:]
+			copy(m.stack[fr.base:], args)
+			m.stack = m.stack[:fr.base+callee.Params]
+			fr = m.enter(callee, fr.base)
+
+		case opRet:
+			res := uint64(0)
+			if fr.fn.Ret {
+				res = m.pop()
+			}
+			m.stack = m.stack[:fr.base]
+
+			if len(m.frames) == 0 {
+				return res, nil
+			}
+			if fr.fn.Ret {
+				m.push(res)
+			}
+			fr = m.frames[len(m.frames)-1]
+			m.frames = m.frames[:len(m.frames)-1]
+
+		default:
+			panic("not implemented")
+		}
+	}
+}
@@ -0,0 +1,373 @@
+// This file contains the WebAssembly text format backend. It works
+// on the checked AST, since the structured control flow of CLI maps
+// onto wasm blocks and loops.
+
+package wasm
+
+import (
+	"clic/ast"
+	"clic/symbol"
+	"clic/types"
+	"fmt"
+	"strings"
+)
+
+type generator struct {
+	t *symbol.Table
+
+	// Every call in tail position is a tail call, not only the
+	// explicit ones
+	tailCalls bool
+
+	// Wasm names of the locals of the current function
+	locals map[symbol.Id]string
+	taken  map[string]bool
+
+	indent int
+	code   string
+}
+
+// External functions are imported from the "env" module. 'main'
+// and the functions marked with 'export' are exported.
+func Codegen(roots []*ast.Node, t *symbol.Table, tailCalls bool) string {
+	g := generator{t: t, tailCalls: tailCalls}
+
+	g.line("(module")
+	g.indent++
+
+	// Imports have to come before the functions, including the
+	// ones declared inside of functions
+	imported := map[string]bool{}
+	for _, root := range roots {
+		ast.Walk(root, func(n *ast.Node) {
+			if n.Tag != ast.NodeFunEx {
+				return
+			}
+			sym := t.Get(n.Id)
+			if !imported[sym.Name] {
+				imported[sym.Name] = true
+				g.line(fmt.Sprintf("(import \"env\" \"%s\" (func $%s%s))", sym.Name, sym.Name, g.signature(n)))
+			}
+		})
+	}
+
+	// The host implements 'syscall', it always gets all the
+	// arguments
+	if ast.Contains(roots, ast.NodeSyscall) {
+		params := strings.Repeat(" (param i64)", maxSyscallArgs+1)
+		g.line(fmt.Sprintf("(import \"env\" \"syscall\" (func $syscall%s (result i64)))", params))
+	}
+
+	for _, node := range roots {
+		if node.Tag == ast.NodeFunDef {
+			g.genFunction(node)
+		}
+	}
+
+	g.indent--
+	g.line(")")
+
+	return g.code
+}
+
+// Arguments of 'syscall' after the number
+const maxSyscallArgs = 6
+
+// Returns the wasm type of a CLI type, "" for void
+func valType(id types.Id) string {
+	switch types.Get(id.Underlying()).Tag {
+	case types.Void:
+		return ""
+	case types.Bool:
+		return "i32"
+	case types.S64, types.U64:
+		return "i64"
+	default:
+		panic("not implemented")
+	}
+}
+
+func isUnsigned(id types.Id) bool {
+	return id.Underlying() == types.GetBuiltin(types.U64)
+}
+
+// Parameters without names and the result
+func (g *generator) signature(n *ast.Node) string {
+	sym := g.t.Get(n.Id)
+
+	sig := ""
+	for _, param := range sym.Fun.Params {
+		sig += " (param " + valType(param.Type) + ")"
+	}
+	if ret := valType(sym.Type); ret != "" {
+		sig += " (result " + ret + ")"
+	}
+	return sig
+}
+
+func (g *generator) line(s string) {
+	g.code += strings.Repeat("  ", g.indent) + s + "\n"
+}
+
+// Locals are declared for the whole function, so shadowed names get
+// the symbol id as a suffix.
+func (g *generator) addLocal(id symbol.Id) string {
+	if name, ok := g.locals[id]; ok {
+		return name
+	}
+
+	name := "$" + g.t.Get(id).Name
+	if g.taken[name] {
+		name = fmt.Sprintf("%s.%d", name, id)
+	}
+	g.taken[name] = true
+	g.locals[id] = name
+	return name
+}
+
+func (g *generator) genFunction(n *ast.Node) {
+	g.locals = make(map[symbol.Id]string)
+	g.taken = make(map[string]bool)
+
+	sym := g.t.Get(n.Id)
+
+	header := "(func $" + sym.Name
+	if sym.Name == "main" || n.Fun.Export {
+		header += fmt.Sprintf(" (export \"%s\")", sym.Name)
+	}
+	for _, param := range n.Fun.Params {
+		header += fmt.Sprintf(" (param %s %s)", g.addLocal(param), valType(g.t.Get(param).Type))
+	}
+	ret := valType(sym.Type)
+	if ret != "" {
+		header += " (result " + ret + ")"
+	}
+	g.line(header)
+	g.indent++
+
+	for _, stmt := range n.Fun.Stmts {
+		ast.Walk(stmt, func(n *ast.Node) {
+			if n.Tag == ast.NodeLVarDecl {
+				name := g.addLocal(n.Id)
+				g.line(fmt.Sprintf("(local %s %s)", name, valType(g.t.Get(n.Id).Type)))
+			}
+		})
+	}
+
+	g.genStmts(n.Fun.Stmts)
+
+	// 'checker' makes sure every path returns, wasm only
+	// knows that if the function ends with a return.
+	stmts := n.Fun.Stmts
+	if ret != "" && (len(stmts) == 0 || stmts[len(stmts)-1].Tag != ast.NodeReturn) {
+		g.line("unreachable")
+	}
+
+	g.indent--
+	g.line(")")
+}
+
+func (g *generator) genStmts(stmts []*ast.Node) {
+	for _, stmt := range stmts {
+		g.genStmt(stmt)
+	}
+}
+
+func (g *generator) genBlock(stmts []*ast.Node) {
+	g.indent++
+	g.genStmts(stmts)
+	g.indent--
+}
+
+func (g *generator) genStmt(n *ast.Node) {
+	switch n.Tag {
+	// Locals are declared at the start of the function and
+	// external functions are imported in 'Codegen'
+	case ast.NodeEmpty, ast.NodeLVarDecl, ast.NodeTypedef, ast.NodeFunEx, ast.NodeFunDecl:
+
+	case ast.NodeScope:
+		g.genStmts(n.Scope.Stmts)
+
+	// 'return_call' needs the tail call extension of wasm, it's
+	// only used when a tail call is asked for, like in the IR.
+	case ast.NodeReturn:
+		val := n.Return.Val
+		if val.Tag == ast.NodeFunCall && (val.Fun.Tail || g.tailCalls) {
+			g.genArgs(val)
+			g.line("return_call $" + g.t.Get(val.Id).Name)
+			break
+		}
+		if val.Tag != ast.NodeEmpty {
+			g.genExpr(val)
+		}
+		g.line("return")
+
+	case ast.NodeIf:
+		g.genExpr(n.If.Exp)
+		g.line("if")
+		g.genBlock(n.If.IfStmts)
+		if len(n.If.ElseStmts) != 0 {
+			g.line("else")
+			g.genBlock(n.If.ElseStmts)
+		}
+		g.line("end")
+
+	case ast.NodeWhile:
+		g.genLoop(n.While.Exp, n.While.Stmts, nil)
+
+	case ast.NodeFor:
+		g.genStmt(n.For.Init)
+		g.genLoop(n.For.Cond, n.For.Stmts, n.For.Adv)
+
+	case ast.NodeBinOp:
+		if n.BinOp.Tag == ast.BinOpAssign {
+			g.genExpr(n.BinOp.Rval)
+			g.line("local.set " + g.locals[n.BinOp.Lval.Id])
+			break
+		}
+		g.genExprStmt(n)
+
+	default:
+		g.genExprStmt(n)
+	}
+}
+
+// The condition is checked at the top of the loop, a false one
+// branches out of the enclosing block.
+func (g *generator) genLoop(cond *ast.Node, stmts []*ast.Node, adv *ast.Node) {
+	g.line("block")
+	g.indent++
+	g.line("loop")
+	g.indent++
+
+	g.genExpr(cond)
+	g.line("i32.eqz")
+	g.line("br_if 1")
+
+	g.genStmts(stmts)
+	if adv != nil {
+		g.genStmt(adv)
+	}
+	g.line("br 0")
+
+	g.indent--
+	g.line("end")
+	g.indent--
+	g.line("end")
+}
+
+func (g *generator) genExprStmt(n *ast.Node) {
+	g.genExpr(n)
+	if valType(n.GetTypeShallow(g.t)) != "" {
+		g.line("drop")
+	}
+}
+
+func (g *generator) genArgs(n *ast.Node) {
+	for _, arg := range n.Fun.Args {
+		g.genExpr(arg)
+	}
+}
+
+var arithInstrs = map[ast.BinOpArithTag]string{
+	ast.BinOpSum:  "add",
+	ast.BinOpSub:  "sub",
+	ast.BinOpMult: "mul",
+	ast.BinOpDiv:  "div_s",
+	ast.BinOpMod:  "rem_s",
+}
+
+var compInstrs = map[ast.BinOpCompTag]string{
+	ast.BinOpEq:      "eq",
+	ast.BinOpNeq:     "ne",
+	ast.BinOpLessEq:  "le_s",
+	ast.BinOpLess:    "lt_s",
+	ast.BinOpGreatEq: "ge_s",
+	ast.BinOpGreat:   "gt_s",
+}
+
+// Operands are pushed left to right, which is the evaluation order
+// of CLI.
+func (g *generator) genExpr(n *ast.Node) {
+	switch n.Tag {
+	case ast.NodeInt:
+		if n.Int.Signed {
+			g.line(fmt.Sprintf("i64.const %d", n.Int.SValue))
+		} else {
+			g.line(fmt.Sprintf("i64.const %d", n.Int.UValue))
+		}
+
+	case ast.NodeBool:
+		if n.Bool.Value {
+			g.line("i32.const 1")
+		} else {
+			g.line("i32.const 0")
+		}
+
+	case ast.NodeLVar:
+		g.line("local.get " + g.locals[n.Id])
+
+	case ast.NodeFunCall:
+		g.genArgs(n)
+		g.line("call $" + g.t.Get(n.Id).Name)
+
+	// Missing arguments are 0
+	case ast.NodeSyscall:
+		for _, arg := range n.Fun.Args {
+			g.genExpr(arg)
+		}
+		for i := len(n.Fun.Args); i <= maxSyscallArgs; i++ {
+			g.line("i64.const 0")
+		}
+		g.line("call $syscall")
+
+	case ast.NodeCast:
+		g.genExpr(n.Cast.What)
+
+		from := valType(n.Cast.What.GetTypeShallow(g.t))
+		to := valType(n.Cast.To)
+		switch {
+		case from == to:
+		case from == "i32" && to == "i64":
+			g.line("i64.extend_i32_u")
+		case from == "i64" && to == "i32":
+			g.line("i64.const 0")
+			g.line("i64.ne")
+		default:
+			panic("not implemented")
+		}
+
+	case ast.NodeBinOp:
+		g.genBinOp(n)
+
+	default:
+		panic("not implemented")
+	}
+}
+
+func (g *generator) genBinOp(n *ast.Node) {
+	if n.BinOp.Tag == ast.BinOpAssign {
+		g.genExpr(n.BinOp.Rval)
+		g.line("local.tee " + g.locals[n.BinOp.Lval.Id])
+		return
+	}
+
+	g.genExpr(n.BinOp.Lval)
+	g.genExpr(n.BinOp.Rval)
+
+	typ := n.BinOp.Lval.GetTypeShallow(g.t)
+	instr := ""
+	switch n.BinOp.Tag {
+	case ast.BinOpArith:
+		instr = arithInstrs[n.BinOp.ArithTag]
+	case ast.BinOpComp:
+		instr = compInstrs[n.BinOp.CompTag]
+	default:
+		panic("not implemented")
+	}
+
+	if isUnsigned(typ) {
+		instr = strings.Replace(instr, "_s", "_u", 1)
+	}
+	g.line(valType(typ) + "." + instr)
+}